@@ -0,0 +1,145 @@
+package main
+
+import (
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+/// Character counting the way the networks do it.
+///
+/// Twitter (twitter-text v3): every link counts as 23, emoji (including their modifiers and ZWJ sequences) count as 2,
+/// code points in the weight_100_ranges count as 1 and everything else (e.g. CJK) as 2.
+///
+/// Mastodon: every link counts as 23 (or whatever the instance says), mentions of remote accounts only count the username part (@user, not @user@domain),
+/// everything else counts grapheme clusters, i.e. what a user would call a character.
+
+const url_character_count_ int = 23
+
+var (
+	count_url_re_            *regexp.Regexp
+	count_remote_mention_re_ *regexp.Regexp
+)
+
+func init() {
+	count_url_re_ = regexp.MustCompile(`https?://[^\s<>"]+[^\s<>".,:;!?'()\[\]]`)
+	count_remote_mention_re_ = regexp.MustCompile(`(^|[^\w/])(@\w+)@[\w.-]+\w`)
+}
+
+/// code points twitter counts with weight 1, all others count 2
+var twitter_weight_100_ranges_ = []struct{ from, to rune }{
+	{0, 4351},
+	{8192, 8205},
+	{8208, 8223},
+	{8242, 8247},
+}
+
+/// split s into (approximately) extended grapheme clusters
+/// We don't need to be perfect here, only to not count combined emoji or accents as more than one character.
+func splitGraphemeClusters(s string) []string {
+	clusters := make([]string, 0, len(s))
+	start := 0
+	join_next := false
+	regional_indicators := 0
+	for idx, r := range s {
+		if idx == 0 {
+			join_next = r == '\u200d'
+			regional_indicators = boolToInt(isRegionalIndicator(r))
+			continue
+		}
+		extends := join_next ||
+			unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+			r == '\u200d' ||
+			(r >= 0xFE00 && r <= 0xFE0F) ||
+			(r >= 0x1F3FB && r <= 0x1F3FF) ||
+			(r >= 0xE0020 && r <= 0xE007F) ||
+			(r == '\n' && s[idx-1] == '\r') ||
+			(isRegionalIndicator(r) && regional_indicators%2 == 1)
+		if !extends {
+			clusters = append(clusters, s[start:idx])
+			start = idx
+			regional_indicators = 0
+		}
+		if isRegionalIndicator(r) {
+			regional_indicators++
+		}
+		join_next = r == '\u200d'
+	}
+	if start < len(s) {
+		clusters = append(clusters, s[start:])
+	}
+	return clusters
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isEmojiCluster(cluster string) bool {
+	first, _ := utf8.DecodeRuneInString(cluster)
+	if (first >= 0x1F000 && first <= 0x1FAFF) || (first >= 0x2600 && first <= 0x27BF) || (first >= 0x2B00 && first <= 0x2BFF) {
+		return true
+	}
+	for _, r := range cluster {
+		if r == '\ufe0f' || r == '\u20e3' {
+			return true
+		}
+	}
+	return false
+}
+
+func twitterRuneWeight(r rune) int {
+	for _, weightrange := range twitter_weight_100_ranges_ {
+		if r >= weightrange.from && r <= weightrange.to {
+			return 1
+		}
+	}
+	return 2
+}
+
+/// count text where links have already been taken out
+func countCharactersTwitterNoLinks(text string) int {
+	count := 0
+	for _, cluster := range splitGraphemeClusters(text) {
+		if isEmojiCluster(cluster) {
+			count += 2
+			continue
+		}
+		for idx, r := range cluster {
+			if idx > 0 && unicode.Is(unicode.Mn, r) {
+				continue // twitter normalizes to NFC first, so e.g. an accent usually does not add anything
+			}
+			count += twitterRuneWeight(r)
+		}
+	}
+	return count
+}
+
+/// call countfn on the text between links and count each link as urllength
+func countWithLinks(text string, urllength int, countfn characterCounter) int {
+	count := 0
+	last := 0
+	for _, loc := range count_url_re_.FindAllStringIndex(text, -1) {
+		count += countfn(text[last:loc[0]]) + urllength
+		last = loc[1]
+	}
+	return count + countfn(text[last:])
+}
+
+func countCharactersTwitter(text string) int {
+	return countWithLinks(text, url_character_count_, countCharactersTwitterNoLinks)
+}
+
+/// urllength is what the instance reserves per link (configuration.statuses.characters_reserved_per_url)
+func countCharactersMastodon(text string, urllength int) int {
+	return countWithLinks(count_remote_mention_re_.ReplaceAllString(text, "$1$2"), urllength, func(s string) int {
+		return len(splitGraphemeClusters(s))
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestCountCharactersTwitter(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{"empty", "", 0},
+		{"ascii", "hello", 5},
+		{"latin accents", "héllo wörld", 11},
+		{"combining accent", "he\u0301llo", 5},
+		{"cjk", "日本語", 6},
+		{"mixed cjk", "a日b", 4},
+		{"en dash weight 1", "a–b", 3},
+		{"ellipsis weight 2", "a…", 3},
+		{"emoji", "👍", 2},
+		{"emoji with skin tone", "👍🏽", 2},
+		{"zwj family", "👨‍👩‍👧", 2},
+		{"flag", "🇩🇪", 2},
+		{"two flags", "🇩🇪🇫🇷", 4},
+		{"emoji presentation selector", "❤️", 2},
+		{"keycap", "1️⃣", 2},
+		{"link", "https://example.com/a/very/long/path/that/is/longer/than/23?x=1", 23},
+		{"link in text", "see https://example.com/some/path ok", 4 + 23 + 3},
+		{"link before full stop", "go to https://example.com.", 6 + 23 + 1},
+		{"two links", "http://a.example/x http://b.example/y", 23 + 1 + 23},
+	}
+	for _, test := range tests {
+		if got := countCharactersTwitter(test.text); got != test.want {
+			t.Errorf("%s: %q counts %d, want %d", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestCountCharactersMastodon(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		urllength int
+		want      int
+	}{
+		{"empty", "", 23, 0},
+		{"ascii", "hello", 23, 5},
+		{"cjk", "日本語", 23, 3},
+		{"combining accent", "he\u0301llo", 23, 5},
+		{"zwj family", "👨‍👩‍👧", 23, 1},
+		{"emoji with skin tone", "👍🏽", 23, 1},
+		{"two flags", "🇩🇪🇫🇷", 23, 2},
+		{"crlf", "a\r\nb", 23, 3},
+		{"link", "https://example.com/a/very/long/path/that/is/longer/than/23?x=1", 23, 23},
+		{"link length of the instance", "see https://example.com/x", 30, 4 + 30},
+		{"local mention", "@alice hi", 23, 9},
+		{"remote mention", "@alice@example.social hi", 23, 9},
+		{"remote mention in text", "hi @alice@example.social and @bob@example.org!", 23, len("hi @alice and @bob!")},
+		{"email address is no mention", "mail bob@example.com", 23, 20},
+	}
+	for _, test := range tests {
+		if got := countCharactersMastodon(test.text, test.urllength); got != test.want {
+			t.Errorf("%s: %q counts %d, want %d", test.name, test.text, got, test.want)
+		}
+	}
+}
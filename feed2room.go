@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"log"
 	"strings"
 
@@ -26,13 +25,26 @@ func (frc *FeedRoomConnector) uploadImageLinkToMatrix(imgurl string) MxUploadedI
 func (frc *FeedRoomConnector) writeNotificationToRoom(notification *mastodon.Notification, mroom string) {
 	log.Println("writeNotificationToRoom:", mroom)
 	text, htmltext := formatNotificationForMatrix(notification)
-	frc.mxcli.SendMessageEvent(mroom, "m.room.message", gomatrix.HTMLMessage{MsgType: "m.notice", Format: "org.matrix.custom.html", Body: text, FormattedBody: htmltext})
+	resp, err := frc.mxcli.SendMessageEvent(mroom, "m.room.message", gomatrix.HTMLMessage{MsgType: "m.notice", Format: "org.matrix.custom.html", Body: text, FormattedBody: htmltext})
+	if err == nil && notification.Status != nil {
+		frc.rememberMirroredStatus(resp.EventID, notification.Status, mroom)
+	}
+}
+
+/// remember which status a notice in the controlling room shows, so users can reply to it
+func (frc *FeedRoomConnector) rememberMirroredStatus(eventid string, status *mastodon.Status, mroom string) {
+	if frc.rums_store_c == nil || mroom != c["matrix"]["room_id"] {
+		return
+	}
+	frc.rums_store_c <- RUMSStoreMsg{key: eventid, data: MsgStatusData{StatusIDs: map[string]string{mastodon_net: string(status.ID)}, Action: actionMirror, Visibility: status.Visibility}}
 }
 
 func (frc *FeedRoomConnector) writeStatusToRoom(status *mastodon.Status, mroom string) {
 	log.Println("writeStatusToRoom:", "status:", status.ID, "to room:", mroom)
 	text, htmltext := formatStatusForMatrix(status)
-	frc.mxcli.SendMessageEvent(mroom, "m.room.message", gomatrix.HTMLMessage{MsgType: "m.notice", Format: "org.matrix.custom.html", Body: text, FormattedBody: htmltext})
+	if resp, err := frc.mxcli.SendMessageEvent(mroom, "m.room.message", gomatrix.HTMLMessage{MsgType: "m.notice", Format: "org.matrix.custom.html", Body: text, FormattedBody: htmltext}); err == nil {
+		frc.rememberMirroredStatus(resp.EventID, status, mroom)
+	}
 
 	if status.MediaAttachments != nil && len(status.MediaAttachments) > 0 && len(status.MediaAttachments) <= feed2matrx_image_count_limit_ {
 		for _, attachment := range status.MediaAttachments {
@@ -126,7 +138,7 @@ func taskFilterMastodonStreamForRoom(frc *FeedRoomConnector, configname string,
 		targetroomduplicatefilter, statusOut)
 }
 
-func taskWriteMastodonBackIntoMatrixRooms(mclient *mastodon.Client, mxcli *gomatrix.Client) (markseen_rv chan<- mastodon.ID) {
+func taskWriteMastodonBackIntoMatrixRooms(mclient *mastodon.Client, mxcli *gomatrix.Client, rums_store_chan chan<- RUMSStoreMsg) (markseen_rv chan<- mastodon.ID) {
 	defer func() {
 		if x := recover(); x != nil {
 			log.Println(x)
@@ -142,6 +154,7 @@ func taskWriteMastodonBackIntoMatrixRooms(mclient *mastodon.Client, mxcli *gomat
 		tclient:        nil,
 		mxcli:          mxcli,
 		mxlinkupload_c: taskUploadImageLinksToMatrix(mxcli),
+		rums_store_c:   rums_store_chan,
 	}
 
 	//configuation for controlling room
@@ -215,24 +228,16 @@ func taskWriteMastodonBackIntoMatrixRooms(mclient *mastodon.Client, mxcli *gomat
 		filter_duplicates_and_selfsent_c, next_in_chain_)
 
 	//subscribe home stream
-	homestream, err := mclient.StreamingUser(context.Background())
-	if err != nil {
-		panic(err)
-	}
 	//--> homestream		--> filter_ownposts_c
 	//						\-> notification2myroom_c
-	go frc.runSplitMastodonEventStream(homestream, filter_ownposts_with_private_c, notification2myroom_c)
+	go frc.runSplitMastodonEventStream(mastodonHomeStreamSource(mclient), filter_ownposts_with_private_c, notification2myroom_c)
 
 	//subscribe tags in addition to home stream
 	for _, tag := range subscribe_tagstreams {
 		log.Println("taskWriteMastodonBackIntoMatrixRooms: subscribing tag", tag)
-		tagstream, err := mclient.StreamingHashtag(context.Background(), tag, false)
-		if err != nil {
-			panic(err)
-		}
 		//--> tagstream			--> next_in_chain_
 		//						\-> nil
-		go frc.runSplitMastodonEventStream(tagstream, next_in_chain_, nil)
+		go frc.runSplitMastodonEventStream(mastodonTagStreamSource(mclient, tag), next_in_chain_, nil)
 	}
 
 	//goroutine writing stuff to controlling room
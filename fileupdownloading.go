@@ -1,163 +1,242 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/hex"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"path"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/btittelbach/cachetable"
 	"github.com/matrix-org/gomatrix"
 )
 
-/// unfortunately, since neither go-twitter, anaconda or go-mastodon implement an io.Reader interface we have to use actual temporary files
+const max_image_bytes_ int64 = 10 * 1024 * 1024
+const alt_text_max_chars_ int = 1500 // mastodon's limit, twitter's is less and we cut there
 
-func checkImageBytesizeLimit(size int64) error {
-	var max_image_bytes int64 = 10 * 1024 * 1024
-	if c["server"]["twitter"] == "true" && size > imgbytes_limit_twitter_ {
-		return fmt.Errorf("Image too large for Twitter. Please shrink to below %d bytes", imgbytes_limit_twitter_)
+var media_filename_re_ *regexp.Regexp
+
+func init() {
+	media_filename_re_ = regexp.MustCompile(`(?i)^[^\n]{0,250}\.(jpe?g|png|gif|webp|heic|heif|avif|tiff?|bmp|mp4|m4v|mov|webm|mkv|mp3|m4a|aac|ogg|oga|opus|wav|flac)$`)
+}
+
+func isImageMediaType(mimetype string) bool { return strings.HasPrefix(mimetype, "image/") }
+func isVideoMediaType(mimetype string) bool { return strings.HasPrefix(mimetype, "video/") }
+func isAudioMediaType(mimetype string) bool { return strings.HasPrefix(mimetype, "audio/") }
+
+/// networks take up to a few images, but video or audio only on their own
+func isSoloMediaType(mimetype string) bool {
+	return isVideoMediaType(mimetype) || isAudioMediaType(mimetype)
+}
+
+/// every enabled network taking this kind of media must take it. Those that don't support it at all just leave it out.
+/// duration is zero if we don't know it.
+/// Images we can shrink only need to be small enough to shrink.
+func checkMediaLimits(mimetype string, size int64, duration time.Duration) error {
+	if shrink_images_ && isShrinkableImageType(mimetype) {
+		if size > shrink_max_source_bytes_ {
+			return fmt.Errorf("Image is too large even to shrink it. Please shrink to below %d bytes", shrink_max_source_bytes_)
+		}
+		size = 0
 	}
-	if c["server"]["mastodon"] == "true" && size > imgbytes_limit_mastodon_ {
-		return fmt.Errorf("Image too large for Mastodon. Please shrink to below %d bytes", imgbytes_limit_mastodon_)
+	supported := false
+	for _, p := range publishers_ {
+		if !p.SupportsMediaType(mimetype) {
+			continue
+		}
+		supported = true
+		if size > p.MediaBytesLimit(mimetype) {
+			return fmt.Errorf("File too large for %s. Please shrink to below %d bytes", p.Name(), p.MediaBytesLimit(mimetype))
+		}
+		if limit := p.MediaDurationLimit(mimetype); limit > 0 && duration > limit {
+			return fmt.Errorf("Too long for %s. Please cut to below %s", p.Name(), limit)
+		}
 	}
-	if size > max_image_bytes {
-		return fmt.Errorf("Image is too large. Please shrink to below %d bytes", max_image_bytes)
+	if !supported {
+		return fmt.Errorf("None of the networks we post to takes %s", mimetype)
+	}
+	if isImageMediaType(mimetype) && size > max_image_bytes_ {
+		return fmt.Errorf("Image is too large. Please shrink to below %d bytes", max_image_bytes_)
 	}
 	return nil
 }
 
-func readFileIntoBase64(filepath string) (string, error) {
-	contents, err := ioutil.ReadFile(filepath)
-	if err != nil {
-		return "", err
+/// names of the networks that will leave out media of mimetype
+func networksNotSupportingMediaType(mimetype string) []string {
+	var rv []string
+	for _, p := range publishers_ {
+		if !p.SupportsMediaType(mimetype) {
+			rv = append(rv, p.Name())
+		}
 	}
-	return base64.StdEncoding.EncodeToString(contents), nil
+	return rv
 }
 
-func osGetLimitedNumElementsInDir(directory string) (int, error) {
-	f, err := os.Open(directory)
-	if err != nil {
-		return 0, err
-	}
-	fileInfo, err := f.Readdir(feed2matrx_image_count_limit_ + 1)
-	f.Close()
-	if err != nil && err != io.EOF {
-		return 0, err
+/// how many images a user may queue for their next post. The least any enabled network accepts, but never more than configured.
+func getUserImageCountLimit() int {
+	limit := feed2matrx_image_count_limit_
+	for _, p := range publishers_ {
+		if p.ImageCountLimit() < limit {
+			limit = p.ImageCountLimit()
+		}
 	}
-	return len(fileInfo), nil
+	return limit
 }
 
-func getUserFileList(nick string) ([]string, error) {
-	userdir := hashNickToUserDir(nick)
-	f, err := os.Open(userdir)
+/// media nick queued for their next post, in the order they queued it
+func getQueuedMedia(nick string) ([]QueuedMedia, error) {
+	queued, err := media_store_.List(nick)
 	if err != nil {
 		return nil, err
 	}
-	names, err := f.Readdirnames(feed2matrx_image_count_limit_)
-	f.Close()
-	if err != nil && err != io.EOF {
-		return nil, err
+	if limit := getUserImageCountLimit(); len(queued) > limit {
+		queued = queued[:limit]
+	}
+	return queued, nil
+}
+
+/// describe the file nick queued with matrix event eventid, or the last one they queued if eventid is empty.
+/// An empty alttext removes the description.
+func setQueuedMediaAltText(nick, eventid, alttext string) error {
+	if len([]rune(alttext)) > alt_text_max_chars_ {
+		return fmt.Errorf("Description too long, %d characters is the limit", alt_text_max_chars_)
+	}
+	queued, err := getQueuedMedia(nick)
+	if err != nil || len(queued) == 0 {
+		return fmt.Errorf("You have nothing queued to describe")
+	}
+	id := queued[len(queued)-1].ID
+	if len(eventid) > 0 {
+		id = queuedMediaID(eventid)
 	}
-	fullnames := make([]string, len(names))
-	for idx, filename := range names {
-		fullnames[idx] = path.Join(userdir, filename)
+	if err = media_store_.SetAltText(nick, id, alttext); os.IsNotExist(err) {
+		return fmt.Errorf("That is nothing you have queued")
 	}
-	return fullnames, nil
+	return err
 }
 
-func saveMatrixFile(cli *gomatrix.Client, nick, eventid, matrixurl string) error {
-	if !strings.Contains(matrixurl, "mxc://") {
-		return fmt.Errorf("image url not a matrix content mxc://..  uri")
+/// MSC2530: if the event names the file, the body is a caption. Otherwise the body is a caption if it does not look like a file name.
+func mxGetMediaCaption(ev *gomatrix.Event) string {
+	body, _ := ev.Content["body"].(string)
+	body = strings.TrimSpace(body)
+	if filename, hasfilename := ev.Content["filename"].(string); hasfilename {
+		if body != filename {
+			return body
+		}
+		return ""
+	}
+	if media_filename_re_.MatchString(body) {
+		return ""
 	}
-	matrixmediaurlpart := strings.Split(matrixurl, "mxc://")[1]
-	userdir, imgfilepath := hashNickAndEventIdToPath(nick, eventid)
-	os.MkdirAll(userdir, 0700)
-	imgtmpfilepath := imgfilepath + ".tmp"
+	return body
+}
 
+/// limit text to maxchars characters
+func truncateRunes(text string, maxchars int) string {
+	runes := []rune(text)
+	if len(runes) <= maxchars {
+		return text
+	}
+	return string(runes[:maxchars])
+}
+
+/// the most bytes any enabled network takes of mimetype. Anything larger we don't even need to download.
+func largestMediaBytesLimit(mimetype string) int64 {
+	var limit int64 = 0
+	for _, p := range publishers_ {
+		if p.SupportsMediaType(mimetype) && p.MediaBytesLimit(mimetype) > limit {
+			limit = p.MediaBytesLimit(mimetype)
+		}
+	}
+	if shrink_images_ && isShrinkableImageType(mimetype) {
+		limit = shrink_max_source_bytes_
+	}
+	return limit
+}
+
+/// download the file of a matrix media event and queue it in media_store_ for nick's next post
+func saveMatrixFile(cli *gomatrix.Client, nick, eventid, matrixurl, mimetype, alttext string) error {
 	/// limit number of files per user
-	numfiles, err := osGetLimitedNumElementsInDir(userdir)
+	queued, err := getQueuedMedia(nick)
 	if err != nil {
 		return err
 	}
-	if numfiles >= feed2matrx_image_count_limit_ {
-		return fmt.Errorf("Too many files stored. %d is the limit.", feed2matrx_image_count_limit_)
+	if imagecountlimit := getUserImageCountLimit(); len(queued) >= imagecountlimit {
+		return fmt.Errorf("Too many files stored. %d is the limit.", imagecountlimit)
+	}
+	for _, media := range queued {
+		if isSoloMediaType(mimetype) || isSoloMediaType(media.MimeType) {
+			return fmt.Errorf("Video or audio can only be posted on its own. Redact what you queued before.")
+		}
 	}
 
-	/// Create the file (implies truncate)
-	fh, err := os.OpenFile(imgtmpfilepath, os.O_WRONLY|os.O_CREATE, 0400)
-	if err != nil {
-		return err
+	/// we can't remove metadata from e.g. HEIC, TIFF or AVIF, and won't post it with the GPS position still in it
+	if strip_image_metadata_ && isImageMediaType(mimetype) && !isStrippableImageType(mimetype) {
+		return fmt.Errorf("Can't remove metadata from %s images. Please send a JPEG, PNG, GIF or WebP instead.", mimetype)
 	}
-	defer fh.Close()
 
 	/// Download image
-	mcxurl := cli.BuildBaseURL("/_matrix/media/r0/download/", matrixmediaurlpart)
-	resp, err := http.Get(mcxurl)
+	resp, err := mxDownloadMedia(cli, matrixurl)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	// Check Filesize (again)
-	if err = checkImageBytesizeLimit(resp.ContentLength); err != nil {
-		os.Remove(imgtmpfilepath) //remove before close will work on unix/bsd. Not sure about windows, but meh.
+	if err = checkMediaLimits(mimetype, resp.ContentLength, 0); err != nil {
 		return err
 	}
+	var contents io.Reader = io.LimitReader(resp.Body, largestMediaBytesLimit(mimetype)+1)
 
-	// Write the body to file
-	var bytes_written int64
-	bytes_written, err = io.Copy(fh, resp.Body)
-	if err != nil {
+	/// remove metadata and shrink if too large for some network. Either may change the type
+	stripmetadata := strip_image_metadata_ && isStrippableImageType(mimetype)
+	shrink := shrink_images_ && isShrinkableImageType(mimetype)
+	if stripmetadata || shrink {
+		imagedata, err := ioutil.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		if err = checkMediaLimits(mimetype, int64(len(imagedata)), 0); err != nil {
+			return err
+		}
+		if stripmetadata {
+			if imagedata, mimetype, err = stripImageMetadata(imagedata, mimetype); err != nil {
+				return fmt.Errorf("Could not remove metadata from image: %s", err.Error())
+			}
+		}
+		if shrink {
+			shrunk, shrunktype, err := shrinkImage(imagedata, mimetype)
+			if err != nil {
+				return err
+			}
+			if shrunk != nil {
+				log.Printf("saveMatrixFile: shrunk %s of %d bytes to %s of %d bytes", mimetype, len(imagedata), shrunktype, len(shrunk))
+				imagedata, mimetype = shrunk, shrunktype
+			}
+		}
+		contents = bytes.NewReader(imagedata)
+	}
+
+	media := QueuedMedia{ID: queuedMediaID(eventid), MimeType: mimetype, AltText: truncateRunes(alttext, alt_text_max_chars_)}
+	if media, err = media_store_.Add(nick, media, contents); err != nil {
 		return err
 	}
 
 	// Check Filesize (again)
-	if err = checkImageBytesizeLimit(bytes_written); err != nil {
-		if resp.ContentLength > 0 {
-			log.Printf("Content-Length lied to us != bytes_written: %d != %d", resp.ContentLength, bytes_written)
+	if err = checkMediaLimits(mimetype, media.Size, 0); err != nil {
+		if resp.ContentLength > 0 && !stripmetadata && !shrink {
+			log.Printf("Content-Length lied to us != bytes_written: %d != %d", resp.ContentLength, media.Size)
 		}
-		os.Remove(imgtmpfilepath) //remove before close will work on unix/bsd. Not sure about windows, but meh.
+		media_store_.Remove(nick, media.ID)
 		return err
 	}
-
-	os.Rename(imgtmpfilepath, imgfilepath)
 	return nil
 }
 
-func rmFile(nick, eventid string) error {
-	// log.Println("removing file for", nick)
-	_, fpath := hashNickAndEventIdToPath(nick, eventid)
-	return os.Remove(fpath)
-}
-
-func rmAllUserFiles(nick string) error {
-	return os.RemoveAll(hashNickToUserDir(nick))
-}
-
-/// return hex(sha256()) of string
-/// used so malicous user can't use malicous filename that is defined by nick. (and hash collision or guessing not so big a threat here.)
-func hashNickToUserDir(matrixnick string) string {
-	shasum := make([]byte, sha256.Size)
-	shasum32 := sha256.Sum256([]byte(matrixnick))
-	copy(shasum[0:sha256.Size], shasum32[0:sha256.Size])
-	return path.Join(temp_image_files_dir_, hex.EncodeToString(shasum))
-}
-
-func hashNickAndEventIdToPath(matrixnick, eventid string) (string, string) {
-	shasum := make([]byte, sha256.Size)
-	shasum32 := sha256.Sum256([]byte(eventid))
-	copy(shasum[0:sha256.Size], shasum32[0:sha256.Size])
-	userdir := hashNickToUserDir(matrixnick)
-	return userdir, path.Join(userdir, hex.EncodeToString(shasum))
-}
-
 type MxUploadedImageInfo struct {
 	mxcurl        string
 	mimetype      string
@@ -180,8 +259,8 @@ func matrixUploadLink(mxcli *gomatrix.Client, url string) (*gomatrix.RespMediaUp
 	}
 	mimetype := response.Header.Get("Content-Type")
 	clength := response.ContentLength
-	if clength > feed2matrx_image_bytes_limit_ {
-		return nil, "", 0, fmt.Errorf("media's size exceeds imagebyteslimit: %d > %d", clength, feed2matrx_image_bytes_limit_)
+	if limit := mxUploadBytesLimit(mxcli, feed2matrx_image_bytes_limit_); clength > limit {
+		return nil, "", 0, fmt.Errorf("media's size exceeds imagebyteslimit or the homeservers upload limit: %d > %d", clength, limit)
 	}
 	rmu, err := mxcli.UploadToContentRepo(response.Body, mimetype, clength)
 	return rmu, mimetype, clength, err
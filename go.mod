@@ -5,10 +5,12 @@ go 1.17
 require (
 	github.com/ChimeraCoder/anaconda v2.0.0+incompatible
 	github.com/btittelbach/cachetable v0.9.1
+	github.com/garyburd/go-oauth v0.0.0-20180319155456-bca2e7f09a17
 	github.com/gokyle/goconfig v0.0.0-20150908043511-373746557f7f
 	github.com/matrix-org/gomatrix v0.0.0-20210324163249-be2af5ef2e16
 	github.com/mattn/go-mastodon v0.0.4
 	github.com/microcosm-cc/bluemonday v1.0.18
+	golang.org/x/image v0.18.0
 	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5
 )
 
@@ -18,7 +20,6 @@ require (
 	github.com/azr/backoff v0.0.0-20160115115103-53511d3c7330 // indirect
 	github.com/dustin/go-jsonpointer v0.0.0-20160814072949-ba0abeacc3dc // indirect
 	github.com/dustin/gojson v0.0.0-20160307161227-2e71ec9dd5ad // indirect
-	github.com/garyburd/go-oauth v0.0.0-20180319155456-bca2e7f09a17 // indirect
 	github.com/gorilla/css v1.0.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/tomnomnom/linkheader v0.0.0-20180905144013-02ca5825eb80 // indirect
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+/// With [images]strip_metadata=true (the default), images lose everything that could tell where, when and with what they were taken
+/// (EXIF including GPS, XMP, IPTC, comments) before we upload them anywhere. Pixels we don't have to touch stay as they are,
+/// only images the camera stored sideways are decoded, turned as the EXIF orientation says and encoded again.
+
+const rotated_jpeg_quality_ int = 92
+const exif_orientation_tag_ uint16 = 0x0112
+
+var jpeg_icc_profile_id_ = []byte("ICC_PROFILE\x00")
+var exif_header_ = []byte("Exif\x00\x00")
+
+func isStrippableImageType(mimetype string) bool {
+	switch mimetype {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+/// returns contents without metadata, upright, and its mime type, which only changes for WebP we had to turn
+func stripImageMetadata(contents []byte, mimetype string) ([]byte, string, error) {
+	switch mimetype {
+	case "image/jpeg":
+		stripped, orientation, err := stripJPEGMetadata(contents)
+		if err != nil || orientation <= 1 {
+			return stripped, mimetype, err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			return nil, mimetype, err
+		}
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, applyExifOrientation(img, orientation), &jpeg.Options{Quality: rotated_jpeg_quality_})
+		return buf.Bytes(), mimetype, err
+	case "image/png":
+		stripped, orientation, err := stripPNGMetadata(contents)
+		if err != nil || orientation <= 1 {
+			return stripped, mimetype, err
+		}
+		img, err := png.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			return nil, mimetype, err
+		}
+		var buf bytes.Buffer
+		err = png.Encode(&buf, applyExifOrientation(img, orientation))
+		return buf.Bytes(), mimetype, err
+	case "image/webp":
+		stripped, orientation, animated, err := stripWebPMetadata(contents)
+		if err != nil || orientation <= 1 || animated {
+			return stripped, mimetype, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			return nil, mimetype, err
+		}
+		return encodeStillImage(applyExifOrientation(img, orientation))
+	case "image/gif":
+		/// comments and XMP live in extension blocks, which the encoder does not write
+		if !bytes.Contains(contents, []byte("XMP DataXMP")) && !bytes.Contains(contents, []byte{0x21, 0xFE}) {
+			return contents, mimetype, nil
+		}
+		anim, err := gif.DecodeAll(bytes.NewReader(contents))
+		if err != nil {
+			return nil, mimetype, err
+		}
+		var buf bytes.Buffer
+		err = gif.EncodeAll(&buf, anim)
+		return buf.Bytes(), mimetype, err
+	}
+	return contents, mimetype, nil
+}
+
+/// as stillImageEncodeType says
+func encodeStillImage(img image.Image) ([]byte, string, error) {
+	var buf bytes.Buffer
+	mimetype := stillImageEncodeType(img)
+	if mimetype == "image/png" {
+		err := png.Encode(&buf, img)
+		return buf.Bytes(), mimetype, err
+	}
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: rotated_jpeg_quality_})
+	return buf.Bytes(), mimetype, err
+}
+
+/// copy all segments except APPn and COM, keeping only JFIF (APP0), ICC profiles (APP2) and Adobe colour info (APP14).
+/// The image data of each scan is copied as is, progressive JPEGs have several. Whatever follows EOI
+/// (like the further pictures of an MPF file) is left out.
+func stripJPEGMetadata(contents []byte) ([]byte, int, error) {
+	if len(contents) < 4 || contents[0] != 0xFF || contents[1] != 0xD8 {
+		return nil, 1, fmt.Errorf("not a jpeg")
+	}
+	orientation := 1
+	out := make([]byte, 0, len(contents))
+	out = append(out, 0xFF, 0xD8)
+	pos := 2
+	for {
+		for pos+1 < len(contents) && contents[pos] == 0xFF && contents[pos+1] == 0xFF {
+			pos++ // fill bytes
+		}
+		if pos+2 > len(contents) || contents[pos] != 0xFF {
+			return nil, 1, fmt.Errorf("broken jpeg")
+		}
+		marker := contents[pos+1]
+		if marker == 0xD9 { // EOI
+			return append(out, 0xFF, 0xD9), orientation, nil
+		}
+		if pos+4 > len(contents) {
+			return nil, 1, fmt.Errorf("broken jpeg")
+		}
+		seglen := int(binary.BigEndian.Uint16(contents[pos+2 : pos+4]))
+		if seglen < 2 || pos+2+seglen > len(contents) {
+			return nil, 1, fmt.Errorf("broken jpeg")
+		}
+		segment := contents[pos : pos+2+seglen]
+		payload := segment[4:]
+		keep := true
+		switch {
+		case marker == 0xE1:
+			if bytes.HasPrefix(payload, exif_header_) {
+				orientation = exifOrientation(payload[len(exif_header_):])
+			}
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(payload, jpeg_icc_profile_id_)
+		case marker == 0xE0 || marker == 0xEE:
+			keep = true
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+			keep = false
+		}
+		if keep {
+			out = append(out, segment...)
+		}
+		pos += 2 + seglen
+		if marker == 0xDA { // start of scan
+			/// image data runs up to the next marker that is neither a stuffed 0xFF nor a restart marker
+			scanend := pos
+			for scanend+1 < len(contents) && !(contents[scanend] == 0xFF && contents[scanend+1] != 0x00 && (contents[scanend+1] < 0xD0 || contents[scanend+1] > 0xD7)) {
+				scanend++
+			}
+			if scanend+1 >= len(contents) {
+				return nil, 1, fmt.Errorf("broken jpeg")
+			}
+			out = append(out, contents[pos:scanend]...)
+			pos = scanend
+		}
+	}
+}
+
+/// drop text, time and exif chunks. Whatever follows IEND is left out.
+func stripPNGMetadata(contents []byte) ([]byte, int, error) {
+	const signaturelen = 8
+	if len(contents) < signaturelen || !bytes.HasPrefix(contents, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, 1, fmt.Errorf("not a png")
+	}
+	orientation := 1
+	out := make([]byte, 0, len(contents))
+	out = append(out, contents[:signaturelen]...)
+	for pos := signaturelen; pos < len(contents); {
+		if pos+12 > len(contents) {
+			return nil, 1, fmt.Errorf("broken png")
+		}
+		datalen := int(binary.BigEndian.Uint32(contents[pos : pos+4]))
+		chunkend := pos + 12 + datalen
+		if chunkend > len(contents) {
+			return nil, 1, fmt.Errorf("broken png")
+		}
+		switch string(contents[pos+4 : pos+8]) {
+		case "eXIf":
+			orientation = exifOrientation(contents[pos+8 : pos+8+datalen])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		case "IEND":
+			return append(out, contents[pos:chunkend]...), orientation, nil
+		default:
+			out = append(out, contents[pos:chunkend]...)
+		}
+		pos = chunkend
+	}
+	return nil, 1, fmt.Errorf("broken png")
+}
+
+/// drop the EXIF and XMP chunks and tell VP8X they are gone. Whatever follows the RIFF container is left out.
+func stripWebPMetadata(contents []byte) ([]byte, int, bool, error) {
+	const headerlen = 12
+	if len(contents) < headerlen || string(contents[0:4]) != "RIFF" || string(contents[8:12]) != "WEBP" {
+		return nil, 1, false, fmt.Errorf("not a webp")
+	}
+	riffend := 8 + int(binary.LittleEndian.Uint32(contents[4:8]))
+	if riffend < headerlen || riffend > len(contents) {
+		return nil, 1, false, fmt.Errorf("broken webp")
+	}
+	contents = contents[:riffend]
+	const vp8x_flag_animation, vp8x_flag_xmp, vp8x_flag_exif = 0x02, 0x04, 0x08
+	orientation := 1
+	animated := false
+	out := make([]byte, 0, len(contents))
+	out = append(out, contents[:headerlen]...)
+	for pos := headerlen; pos < len(contents); {
+		if pos+8 > len(contents) {
+			return nil, 1, false, fmt.Errorf("broken webp")
+		}
+		datalen := int(binary.LittleEndian.Uint32(contents[pos+4 : pos+8]))
+		chunkend := pos + 8 + datalen + datalen%2
+		if datalen < 0 || pos+8+datalen > len(contents) {
+			return nil, 1, false, fmt.Errorf("broken webp")
+		}
+		if chunkend > len(contents) {
+			chunkend = len(contents)
+		}
+		switch string(contents[pos : pos+4]) {
+		case "EXIF":
+			data := contents[pos+8 : pos+8+datalen]
+			orientation = exifOrientation(bytes.TrimPrefix(data, exif_header_))
+		case "XMP ":
+		case "VP8X":
+			chunk := append([]byte{}, contents[pos:chunkend]...)
+			if datalen > 0 {
+				animated = chunk[8]&vp8x_flag_animation != 0
+				chunk[8] &^= vp8x_flag_xmp | vp8x_flag_exif
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, contents[pos:chunkend]...)
+		}
+		pos = chunkend
+	}
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, orientation, animated, nil
+}
+
+/// the orientation tag from IFD0 of a TIFF structure as found in EXIF, 1 (upright) if there is none
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	numentries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for entry := 0; entry < numentries; entry++ {
+		pos := ifd + 2 + entry*12
+		if pos+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[pos:pos+2]) == exif_orientation_tag_ {
+			if orientation := int(order.Uint16(tiff[pos+8 : pos+10])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+/// turn and mirror img the way EXIF orientation 2 to 8 says it should be displayed
+func applyExifOrientation(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	width, height := bounds.Dx(), bounds.Dy()
+	dstwidth, dstheight := width, height
+	if orientation >= 5 {
+		dstwidth, dstheight = height, width
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstwidth, dstheight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
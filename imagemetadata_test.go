@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+/// 1x1 lossless WebP, a bare VP8L chunk
+const test_webp_base64_ string = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+/// 3x2 pixels, each of its own colour, so we can tell where each one ended up
+func testImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(40 * (x + 1)), G: uint8(100 * y), B: 7, A: 255})
+		}
+	}
+	return img
+}
+
+/// EXIF as a TIFF structure with an orientation and a made up GPS position in IFD0
+func testTIFF(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+2*12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:4], 42)
+	order.PutUint32(tiff[4:8], 8)
+	order.PutUint16(tiff[8:10], 2)
+	entry := tiff[10:22]
+	order.PutUint16(entry[0:2], exif_orientation_tag_)
+	order.PutUint16(entry[2:4], 3) // SHORT
+	order.PutUint32(entry[4:8], 1)
+	order.PutUint16(entry[8:10], orientation)
+	entry = tiff[22:34]
+	order.PutUint16(entry[0:2], 0x8825) // GPSInfo
+	order.PutUint16(entry[2:4], 4)      // LONG
+	order.PutUint32(entry[4:8], 1)
+	order.PutUint32(entry[8:12], 0)
+	return append(tiff, "GPS 52.5N 13.4E"...)
+}
+
+func testJPEGSegment(marker byte, payload string) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+/// a JPEG of img with segments right after SOI
+func testJPEG(t *testing.T, img image.Image, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	contents := append([]byte{}, encoded[:2]...)
+	for _, segment := range segments {
+		contents = append(contents, segment...)
+	}
+	return append(contents, encoded[2:]...)
+}
+
+/// a JPEG of img with segments between the image data and EOI, where progressive JPEGs have their further scans
+func testJPEGAfterScan(t *testing.T, img image.Image, segments ...[]byte) []byte {
+	encoded := testJPEG(t, img)
+	contents := append([]byte{}, encoded[:len(encoded)-2]...)
+	for _, segment := range segments {
+		contents = append(contents, segment...)
+	}
+	return append(contents, 0xFF, 0xD9)
+}
+
+func testPNGChunk(chunktype, data string) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(data)))
+	copy(chunk[4:8], chunktype)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+/// a PNG of img with chunks right after IHDR
+func testPNG(t *testing.T, img image.Image, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	const ihdrend = 8 + 12 + 13
+	contents := append([]byte{}, encoded[:ihdrend]...)
+	for _, chunk := range chunks {
+		contents = append(contents, chunk...)
+	}
+	return append(contents, encoded[ihdrend:]...)
+}
+
+func testWebPChunk(chunktype, data string) []byte {
+	chunk := make([]byte, 8, 9+len(data))
+	copy(chunk[0:4], chunktype)
+	binary.LittleEndian.PutUint32(chunk[4:8], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+/// the 1x1 WebP in the extended format, with VP8X flags for EXIF and XMP and chunks before the image
+func testWebP(t *testing.T, chunks ...[]byte) []byte {
+	simple, err := base64.StdEncoding.DecodeString(test_webp_base64_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const vp8x_flags = 0x08 | 0x04
+	contents := append([]byte("RIFF\x00\x00\x00\x00WEBP"), testWebPChunk("VP8X", string([]byte{vp8x_flags, 0, 0, 0, 0, 0, 0, 0, 0, 0}))...)
+	for _, chunk := range chunks {
+		contents = append(contents, chunk...)
+	}
+	contents = append(contents, simple[12:]...)
+	binary.LittleEndian.PutUint32(contents[4:8], uint32(len(contents)-8))
+	return contents
+}
+
+func TestStripImageMetadataRemoves(t *testing.T) {
+	exif := "Exif\x00\x00" + string(testTIFF(binary.BigEndian, 1))
+	xmp := "<x:xmpmeta xmlns:x='adobe:ns:meta/'><exif:GPSLatitude>52.5</exif:GPSLatitude></x:xmpmeta>"
+	tests := []struct {
+		name     string
+		mimetype string
+		contents []byte
+		gone     []string
+		kept     []string
+	}{
+		{"jpeg exif xmp iptc comment", "image/jpeg", testJPEG(t, testImage(),
+			testJPEGSegment(0xE1, exif),
+			testJPEGSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00"+xmp),
+			testJPEGSegment(0xED, "Photoshop 3.0\x008BIM\x04\x04 by someone"),
+			testJPEGSegment(0xFE, "shot at home"),
+			testJPEGSegment(0xE2, "MPF\x00 second picture")),
+			[]string{"GPS 52.5N", "xmpmeta", "Photoshop 3.0", "shot at home", "MPF\x00"}, nil},
+		{"jpeg jfif icc adobe", "image/jpeg", testJPEG(t, testImage(),
+			testJPEGSegment(0xE0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"),
+			testJPEGSegment(0xE2, "ICC_PROFILE\x00\x01\x01 sRGB profile"),
+			testJPEGSegment(0xEE, "Adobe\x00\x64\x00\x00\x00\x00\x01")),
+			nil, []string{"JFIF\x00", "ICC_PROFILE\x00\x01\x01 sRGB profile", "Adobe\x00"}},
+		{"jpeg trailing data", "image/jpeg", append(testJPEG(t, testImage()), "GPS 52.5N appended"...),
+			[]string{"GPS 52.5N"}, nil},
+		{"jpeg comment after the scan", "image/jpeg", testJPEGAfterScan(t, testImage(), testJPEGSegment(0xFE, "shot at home")),
+			[]string{"shot at home"}, nil},
+		{"png text time exif", "image/png", testPNG(t, testImage(),
+			testPNGChunk("tEXt", "Comment\x00shot at home"),
+			testPNGChunk("zTXt", "Author\x00\x00x\x9c"),
+			testPNGChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00"+xmp),
+			testPNGChunk("tIME", "\x07\xe6\x01\x02\x03\x04\x05"),
+			testPNGChunk("eXIf", string(testTIFF(binary.LittleEndian, 1)))),
+			[]string{"shot at home", "Author", "xmpmeta", "tIME", "GPS 52.5N"}, nil},
+		{"png icc and physical size", "image/png", testPNG(t, testImage(),
+			testPNGChunk("iCCP", "sRGB\x00\x00x\x9c"),
+			testPNGChunk("pHYs", "\x00\x00\x0b\x13\x00\x00\x0b\x13\x01")),
+			nil, []string{"iCCPsRGB", "pHYs"}},
+		{"png trailing data", "image/png", append(testPNG(t, testImage()), "GPS 52.5N appended"...),
+			[]string{"GPS 52.5N"}, nil},
+		{"webp exif xmp", "image/webp", testWebP(t,
+			testWebPChunk("ICCP", "sRGB profile"),
+			testWebPChunk("EXIF", exif),
+			testWebPChunk("XMP ", xmp)),
+			[]string{"EXIF", "GPS 52.5N", "XMP ", "xmpmeta"}, []string{"ICCP", "sRGB profile"}},
+	}
+	for _, test := range tests {
+		stripped, mimetype, err := stripImageMetadata(test.contents, test.mimetype)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if mimetype != test.mimetype {
+			t.Errorf("%s: became %s", test.name, mimetype)
+		}
+		for _, gone := range test.gone {
+			if bytes.Contains(stripped, []byte(gone)) {
+				t.Errorf("%s: still contains %q", test.name, gone)
+			}
+		}
+		for _, kept := range test.kept {
+			if !bytes.Contains(stripped, []byte(kept)) {
+				t.Errorf("%s: lost %q", test.name, kept)
+			}
+		}
+		var img image.Image
+		switch test.mimetype {
+		case "image/jpeg":
+			img, err = jpeg.Decode(bytes.NewReader(stripped))
+		case "image/png":
+			img, err = png.Decode(bytes.NewReader(stripped))
+		case "image/webp":
+			img, err = webp.Decode(bytes.NewReader(stripped))
+			if err == nil && stripped[20]&(0x08|0x04) != 0 {
+				t.Errorf("%s: VP8X still announces EXIF or XMP", test.name)
+			}
+			if err == nil && int(binary.LittleEndian.Uint32(stripped[4:8])) != len(stripped)-8 {
+				t.Errorf("%s: wrong RIFF size", test.name)
+			}
+		}
+		if err != nil {
+			t.Errorf("%s: can't decode the result: %s", test.name, err)
+		} else if img.Bounds().Dx() == 0 {
+			t.Errorf("%s: empty result", test.name)
+		}
+	}
+}
+
+/// the pixel rows of testImage() as displayed with each EXIF orientation, a to f standing for the pixels
+/// a b c
+/// d e f
+var test_orientations_ = map[int][]string{
+	1: {"abc", "def"},
+	2: {"cba", "fed"},
+	3: {"fed", "cba"},
+	4: {"def", "abc"},
+	5: {"ad", "be", "cf"},
+	6: {"da", "eb", "fc"},
+	7: {"fc", "eb", "da"},
+	8: {"cf", "be", "ad"},
+}
+
+func TestStripImageMetadataOrientation(t *testing.T) {
+	src := testImage()
+	pixel := func(name byte) color.NRGBA {
+		idx := int(name - 'a')
+		return src.NRGBAAt(idx%3, idx/3)
+	}
+	for orientation, rows := range test_orientations_ {
+		/// PNG is lossless, so every pixel must be where the orientation says
+		contents := testPNG(t, src, testPNGChunk("eXIf", string(testTIFF(binary.LittleEndian, uint16(orientation)))))
+		stripped, _, err := stripImageMetadata(contents, "image/png")
+		if err != nil {
+			t.Errorf("png orientation %d: %s", orientation, err)
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			t.Errorf("png orientation %d: %s", orientation, err)
+			continue
+		}
+		if img.Bounds().Dx() != len(rows[0]) || img.Bounds().Dy() != len(rows) {
+			t.Errorf("png orientation %d: is %v", orientation, img.Bounds())
+			continue
+		}
+		for y, row := range rows {
+			for x := range row {
+				if got := color.NRGBAModel.Convert(img.At(x, y)); got != pixel(row[x]) {
+					t.Errorf("png orientation %d: pixel %d,%d is %v, want %c", orientation, x, y, got, row[x])
+				}
+			}
+		}
+
+		/// JPEG is not, but width and height still tell whether it was turned
+		contents = testJPEG(t, src, testJPEGSegment(0xE1, "Exif\x00\x00"+string(testTIFF(binary.BigEndian, uint16(orientation)))))
+		if stripped, _, err = stripImageMetadata(contents, "image/jpeg"); err != nil {
+			t.Errorf("jpeg orientation %d: %s", orientation, err)
+			continue
+		}
+		if img, err = jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("jpeg orientation %d: %s", orientation, err)
+		} else if img.Bounds().Dx() != len(rows[0]) || img.Bounds().Dy() != len(rows) {
+			t.Errorf("jpeg orientation %d: is %v", orientation, img.Bounds())
+		}
+	}
+
+	/// we can't write WebP, so a turned one comes back as JPEG or PNG
+	contents := testWebP(t, testWebPChunk("EXIF", "Exif\x00\x00"+string(testTIFF(binary.LittleEndian, 6))))
+	stripped, mimetype, err := stripImageMetadata(contents, "image/webp")
+	if err != nil {
+		t.Errorf("webp orientation 6: %s", err)
+	} else if mimetype != "image/jpeg" && mimetype != "image/png" {
+		t.Errorf("webp orientation 6: became %s", mimetype)
+	} else if _, _, err = image.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("webp orientation 6: %s", err)
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	broken_order := testTIFF(binary.LittleEndian, 6)
+	copy(broken_order, "XX")
+	ifd_out_of_range := testTIFF(binary.BigEndian, 6)
+	binary.BigEndian.PutUint32(ifd_out_of_range[4:8], 1000)
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little endian", testTIFF(binary.LittleEndian, 8), 8},
+		{"big endian", testTIFF(binary.BigEndian, 3), 3},
+		{"no such orientation", testTIFF(binary.BigEndian, 9), 1},
+		{"empty", nil, 1},
+		{"truncated header", testTIFF(binary.BigEndian, 6)[:6], 1},
+		{"truncated entries", testTIFF(binary.BigEndian, 6)[:15], 1},
+		{"byte order", broken_order, 1},
+		{"ifd out of range", ifd_out_of_range, 1},
+	}
+	for _, test := range tests {
+		if got := exifOrientation(test.tiff); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStripImageMetadataBroken(t *testing.T) {
+	exifsegment := testJPEGSegment(0xE1, "Exif\x00\x00"+string(testTIFF(binary.BigEndian, 1)))
+	jpegcontents := testJPEG(t, testImage(), exifsegment)
+	pngcontents := testPNG(t, testImage(), testPNGChunk("tEXt", "Comment\x00shot at home"))
+	webpcontents := testWebP(t, testWebPChunk("EXIF", "Exif\x00\x00"+string(testTIFF(binary.LittleEndian, 1))))
+	bad_segment_length := append([]byte{}, jpegcontents...)
+	binary.BigEndian.PutUint16(bad_segment_length[4:6], 1)
+	huge_riff_size := append([]byte{}, webpcontents...)
+	binary.LittleEndian.PutUint32(huge_riff_size[4:8], uint32(len(webpcontents)))
+	tests := []struct {
+		name     string
+		mimetype string
+		contents []byte
+	}{
+		{"jpeg without SOI", "image/jpeg", jpegcontents[2:]},
+		{"jpeg only SOI", "image/jpeg", jpegcontents[:2]},
+		{"jpeg cut in exif", "image/jpeg", jpegcontents[:20]},
+		{"jpeg cut after headers", "image/jpeg", jpegcontents[:2+len(exifsegment)]},
+		{"jpeg cut in image data", "image/jpeg", jpegcontents[:len(jpegcontents)-2]},
+		{"jpeg bad segment length", "image/jpeg", bad_segment_length},
+		{"png without signature", "image/png", pngcontents[8:]},
+		{"png cut in chunk", "image/png", pngcontents[:40]},
+		{"png cut before IEND", "image/png", pngcontents[:len(pngcontents)-12]},
+		{"webp without header", "image/webp", webpcontents[12:]},
+		{"webp cut in chunk", "image/webp", webpcontents[:len(webpcontents)-4]},
+		{"webp riff larger than file", "image/webp", huge_riff_size},
+	}
+	for _, test := range tests {
+		stripped, _, err := stripImageMetadata(test.contents, test.mimetype)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+		if stripped != nil {
+			t.Errorf("%s: returned %d bytes", test.name, len(stripped))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+/// With [images]shrink=true, images too large for an enabled network are scaled down and recompressed
+/// until they fit the strictest network taking them, instead of being refused.
+/// We can't write WebP, so anything we have to touch becomes JPEG, or PNG if it is transparent.
+/// Animated GIFs stay animated GIFs if we can get them small enough, otherwise they become a still of their first frame.
+
+const shrink_max_source_bytes_ int64 = 50 * 1024 * 1024
+const shrink_max_source_pixels_ int64 = 100 * 1000 * 1000 // a small file may well decompress into gigabytes
+const shrink_scale_step_ float64 = 0.8
+const shrink_min_long_side_ int = 320 // smaller isn't worth posting any more
+
+var shrink_jpeg_qualities_ = []int{90, 80, 70, 60}
+
+func isShrinkableImageType(mimetype string) bool {
+	switch mimetype {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	}
+	return false
+}
+
+/// zero maxside or maxpixels mean no limit
+type imageLimits struct {
+	maxbytes  int64
+	maxside   int
+	maxpixels int64
+}
+
+/// the strictest limits of all enabled networks taking images of mimetype
+func strictestImageLimits(mimetype string) imageLimits {
+	limits := imageLimits{maxbytes: max_image_bytes_}
+	for _, p := range publishers_ {
+		if !p.SupportsMediaType(mimetype) {
+			continue
+		}
+		if maxbytes := p.MediaBytesLimit(mimetype); maxbytes < limits.maxbytes {
+			limits.maxbytes = maxbytes
+		}
+		maxside, maxpixels := p.ImageDimensionLimit()
+		if maxside > 0 && (limits.maxside == 0 || maxside < limits.maxside) {
+			limits.maxside = maxside
+		}
+		if maxpixels > 0 && (limits.maxpixels == 0 || maxpixels < limits.maxpixels) {
+			limits.maxpixels = maxpixels
+		}
+	}
+	return limits
+}
+
+func (limits imageLimits) fits(size int64, width, height int) bool {
+	if size > limits.maxbytes {
+		return false
+	}
+	if limits.maxside > 0 && (width > limits.maxside || height > limits.maxside) {
+		return false
+	}
+	return limits.maxpixels == 0 || int64(width)*int64(height) <= limits.maxpixels
+}
+
+/// largest width and height with the same aspect ratio that fit limits
+func (limits imageLimits) fitDimensions(width, height int) (int, int) {
+	scale := 1.0
+	if longside := maxInt(width, height); limits.maxside > 0 && longside > limits.maxside {
+		scale = float64(limits.maxside) / float64(longside)
+	}
+	if pixels := float64(width) * float64(height); limits.maxpixels > 0 && pixels*scale*scale > float64(limits.maxpixels) {
+		scale = math.Sqrt(float64(limits.maxpixels) / pixels)
+	}
+	return scaleDimensions(width, height, scale)
+}
+
+func scaleDimensions(width, height int, scale float64) (int, int) {
+	return maxInt(1, int(float64(width)*scale)), maxInt(1, int(float64(height)*scale))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+/// returns contents shrunk to fit all enabled networks and its new mime type.
+/// Returns nil if contents already fit.
+func shrinkImage(contents []byte, mimetype string) ([]byte, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil {
+		return nil, mimetype, fmt.Errorf("Can't read that image: %s", err.Error())
+	}
+	if strictestImageLimits(mimetype).fits(int64(len(contents)), config.Width, config.Height) {
+		return nil, mimetype, nil
+	}
+	if int64(config.Width)*int64(config.Height) > shrink_max_source_pixels_ {
+		return nil, mimetype, fmt.Errorf("Image has too many pixels to shrink it. Please shrink to below %d pixels", shrink_max_source_pixels_)
+	}
+	var img image.Image
+	if format == "gif" {
+		anim, err := gif.DecodeAll(bytes.NewReader(contents))
+		if err != nil {
+			return nil, mimetype, fmt.Errorf("Can't read that image: %s", err.Error())
+		}
+		if len(anim.Image) > 1 {
+			if shrunk, err := shrinkAnimatedGIF(anim); err == nil {
+				return shrunk, "image/gif", nil
+			}
+		}
+		img = anim.Image[0]
+	} else if img, _, err = image.Decode(bytes.NewReader(contents)); err != nil {
+		return nil, mimetype, fmt.Errorf("Can't read that image: %s", err.Error())
+	}
+	return shrinkStillImage(img)
+}
+
+/// what we write a still image as. We can't write WebP, so JPEG, or PNG if there is transparency to keep
+func stillImageEncodeType(img image.Image) string {
+	if opaque, canknow := img.(interface{ Opaque() bool }); canknow && !opaque.Opaque() {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+func shrinkStillImage(img image.Image) ([]byte, string, error) {
+	mimetype := stillImageEncodeType(img)
+	limits := strictestImageLimits(mimetype)
+	width, height := limits.fitDimensions(img.Bounds().Dx(), img.Bounds().Dy())
+	for maxInt(width, height) >= shrink_min_long_side_ {
+		scaled := img
+		if width != img.Bounds().Dx() || height != img.Bounds().Dy() {
+			dst := image.NewRGBA(image.Rect(0, 0, width, height))
+			draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+			scaled = dst
+		}
+		var buf bytes.Buffer
+		if mimetype == "image/png" {
+			encoder := png.Encoder{CompressionLevel: png.BestCompression}
+			if err := encoder.Encode(&buf, scaled); err != nil {
+				return nil, mimetype, err
+			}
+			if limits.fits(int64(buf.Len()), width, height) {
+				return buf.Bytes(), mimetype, nil
+			}
+		} else {
+			for _, quality := range shrink_jpeg_qualities_ {
+				buf.Reset()
+				if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: quality}); err != nil {
+					return nil, mimetype, err
+				}
+				if limits.fits(int64(buf.Len()), width, height) {
+					return buf.Bytes(), mimetype, nil
+				}
+			}
+		}
+		width, height = scaleDimensions(width, height, shrink_scale_step_)
+	}
+	return nil, mimetype, fmt.Errorf("Could not shrink that image enough. Please shrink to below %d bytes", limits.maxbytes)
+}
+
+/// scale every frame of anim until the whole thing fits
+func shrinkAnimatedGIF(anim *gif.GIF) ([]byte, error) {
+	limits := strictestImageLimits("image/gif")
+	width, height := limits.fitDimensions(anim.Config.Width, anim.Config.Height)
+	for maxInt(width, height) >= shrink_min_long_side_ {
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, scaleGIF(anim, width, height)); err != nil {
+			return nil, err
+		}
+		if limits.fits(int64(buf.Len()), width, height) {
+			return buf.Bytes(), nil
+		}
+		width, height = scaleDimensions(width, height, shrink_scale_step_)
+	}
+	return nil, fmt.Errorf("could not shrink animated gif enough")
+}
+
+/// frames only cover the part of the canvas that changes, so each one is scaled to its place on the new canvas.
+/// Nearest neighbour keeps to the palette.
+func scaleGIF(anim *gif.GIF, width, height int) *gif.GIF {
+	scalex := float64(width) / float64(anim.Config.Width)
+	scaley := float64(height) / float64(anim.Config.Height)
+	canvas := image.Rect(0, 0, width, height)
+	scaled := &gif.GIF{
+		Image:           make([]*image.Paletted, 0, len(anim.Image)),
+		Delay:           anim.Delay,
+		Disposal:        anim.Disposal,
+		LoopCount:       anim.LoopCount,
+		BackgroundIndex: anim.BackgroundIndex,
+		Config:          image.Config{ColorModel: anim.Config.ColorModel, Width: width, Height: height},
+	}
+	for _, frame := range anim.Image {
+		bounds := frame.Bounds()
+		rect := image.Rect(
+			int(math.Floor(float64(bounds.Min.X)*scalex)), int(math.Floor(float64(bounds.Min.Y)*scaley)),
+			int(math.Ceil(float64(bounds.Max.X)*scalex)), int(math.Ceil(float64(bounds.Max.Y)*scaley)),
+		).Intersect(canvas)
+		if rect.Empty() {
+			rect = image.Rect(0, 0, 1, 1)
+		}
+		dst := image.NewPaletted(rect, frame.Palette)
+		draw.NearestNeighbor.Scale(dst, rect, frame, bounds, draw.Src, nil)
+		scaled.Image = append(scaled.Image, dst)
+	}
+	return scaled
+}
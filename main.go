@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gokyle/goconfig"
 	"suah.dev/protect"
@@ -18,12 +19,24 @@ import (
 var (
 	c                              goconfig.ConfigMap
 	temp_image_files_dir_          string
+	media_store_                   MediaStore
 	feed2matrx_image_bytes_limit_  int64
 	feed2matrx_image_count_limit_  int
+	mastodon_updates_              string
+	mastodon_poll_interval_        time.Duration
 	matrix_notice_character_limit_ int = 1000
 	guard_prefix_                  string
 	reblog_cmd_                    string
 	favourite_cmd_                 string
+	schedule_cmd_                  string
+	alt_cmd_                       string
+	state_dir_                     string
+	split_into_thread_             bool
+	shrink_images_                 bool
+	strip_image_metadata_          bool
+	thread_max_parts_              int
+	rums_retention_                time.Duration
+	poll_duration_                 time.Duration
 )
 
 /// Function Name Coding Standard
@@ -32,18 +45,40 @@ var (
 
 func mainWithDefers() {
 	var err error
-	//// Create image temp dir if needed
+	//// Create image store and its temp dir if needed
+	media_store_ = nil
 	if c.GetValueDefault("images", "enabled", "false") == "true" {
-		temp_image_files_dir_, err = ioutil.TempDir(c.GetValueDefault("images", "temp_dir", "/tmp"), "mycete")
-		if err != nil {
-			panic(err)
-		}
-		if err = os.Chmod(temp_image_files_dir_, 0700); err != nil {
-			panic(err)
+		switch c.GetValueDefault("images", "store", "dir") {
+		case "dir":
+			temp_image_files_dir_, err = ioutil.TempDir(c.GetValueDefault("images", "temp_dir", "/tmp"), "mycete")
+			if err != nil {
+				panic(err)
+			}
+			if err = os.Chmod(temp_image_files_dir_, 0700); err != nil {
+				panic(err)
+			}
+			defer os.RemoveAll(temp_image_files_dir_)
+			media_store_ = newDirMediaStore(temp_image_files_dir_)
+		case "memory":
+			memory_limit, err := strconv.ParseInt(c.GetValueDefault("images", "memory_limit", "104857600"), 10, 64)
+			if err != nil {
+				panic(err)
+			}
+			media_store_ = newMemoryMediaStore(memory_limit)
+		default:
+			panic("ERROR: [images]store must be dir or memory")
 		}
-		defer os.RemoveAll(temp_image_files_dir_)
 	}
 
+	/// from here on we only write to disk if we keep images or state there
+	if len(temp_image_files_dir_) > 0 || len(state_dir_) > 0 {
+		_ = protect.Pledge("stdio rpath cpath wpath inet dns")
+	} else {
+		_ = protect.Pledge("stdio rpath inet dns")
+	}
+	shrink_images_ = c.GetValueDefault("images", "shrink", "false") == "true"
+	strip_image_metadata_ = c.GetValueDefault("images", "strip_metadata", "true") == "true"
+
 	///////////////////////////////////////////////////////////
 	//// Start Bot and all Sub-Go-Routines
 	go runMatrixPublishBot()
@@ -61,6 +96,9 @@ func main() {
 	var err error
 
 	cfile := flag.String("conf", "/etc/mycete.conf", "Configuration file")
+	logout := flag.Bool("logout", false, "Log out the matrix session stored in [state]dir and exit")
+	cleanupdevices := flag.Bool("cleanup-devices", false, "List matrix devices left behind by earlier logins and exit")
+	confirm := flag.Bool("confirm", false, "With -cleanup-devices, delete the devices it lists")
 	flag.Parse()
 
 	_ = protect.Pledge("stdio rpath cpath wpath fattr inet dns")
@@ -86,13 +124,64 @@ func main() {
 	if feed2matrx_image_count_limit_, err = strconv.Atoi(c.GetValueDefault("feed2matrix", "imagecountlimit", "4")); err != nil {
 		panic(err)
 	}
+	mastodon_updates_ = c.GetValueDefault("feed2matrix", "updates", "auto")
+	if mastodon_updates_ != "auto" && mastodon_updates_ != "stream" && mastodon_updates_ != "poll" {
+		panic("ERROR: [feed2matrix]updates must be auto, stream or poll")
+	}
+	if poll_interval_seconds, err := strconv.Atoi(c.GetValueDefault("feed2matrix", "poll_interval", "60")); err == nil && poll_interval_seconds > 0 {
+		mastodon_poll_interval_ = time.Duration(poll_interval_seconds) * time.Second
+	} else {
+		panic("ERROR: [feed2matrix]poll_interval must be a number of seconds")
+	}
 
 	guard_prefix_ = strings.TrimSpace(c.GetValueDefault("matrix", "guard_prefix", "t>"))
 	reblog_cmd_ = strings.TrimSpace(c.GetValueDefault("matrix", "reblog_cmd", "reblog>"))
 	favourite_cmd_ = strings.TrimSpace(c.GetValueDefault("matrix", "favourite_cmd", "+1>"))
-	if guard_prefix_ == reblog_cmd_ || reblog_cmd_ == favourite_cmd_ || favourite_cmd_ == guard_prefix_ {
-		panic("ERROR: guard_prefix, reblog_cmd or favourite_cmd MUST differ")
-	} //https://chaos.social/@realraum/101880653017828628
+	schedule_cmd_ = strings.TrimSpace(c.GetValueDefault("matrix", "schedule_cmd", "schedule>"))
+	alt_cmd_ = strings.TrimSpace(c.GetValueDefault("matrix", "alt_cmd", "alt>"))
+	if timezone := strings.TrimSpace(c.GetValueDefault("matrix", "timezone", "")); len(timezone) > 0 {
+		if schedule_location_, err = time.LoadLocation(timezone); err != nil {
+			panic(err)
+		}
+	}
+
+	split_into_thread_ = c.GetValueDefault("matrix", "split_into_thread", "false") == "true"
+	if thread_max_parts_, err = strconv.Atoi(c.GetValueDefault("matrix", "thread_max_parts", "10")); err != nil {
+		panic(err)
+	}
+
+	if poll_duration_, err = parsePollDuration(c.GetValueDefault("matrix", "poll_duration", "1d")); err != nil {
+		panic(err)
+	}
+
+	state_dir_ = strings.TrimSpace(c.GetValueDefault("state", "dir", ""))
+	if len(state_dir_) > 0 {
+		if err = os.MkdirAll(state_dir_, 0700); err != nil {
+			panic(err)
+		}
+	}
+	if retention_days, err := strconv.Atoi(c.GetValueDefault("state", "retention_days", "30")); err == nil {
+		rums_retention_ = time.Duration(retention_days) * 24 * time.Hour
+	} else {
+		panic(err)
+	}
+
+	if *logout || *cleanupdevices {
+		if *logout {
+			err = mxLogoutStoredSession()
+		} else {
+			err = mxCleanupDevices(*confirm)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	initPublishers()
+	initPostingProfiles()
+	checkPrefixesDiffer()
 
 	////////////////////////////////////////////////////////////
 	//// run main Main where a defer will still be called before we exit
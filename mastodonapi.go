@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mastodon "github.com/mattn/go-mastodon"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+const mastodon_media_processing_wait_ time.Duration = 2 * time.Second
+const mastodon_media_processing_tries_ int = 150
+
+type mastodonAPIError struct {
+	Method     string
+	URI        string
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *mastodonAPIError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.URI, e.Status, e.Body)
+}
+
+func isMastodonNotFound(err error) bool {
+	apierr, ok := err.(*mastodonAPIError)
+	return ok && apierr.StatusCode == http.StatusNotFound
+}
+
+/// what servers answer to endpoints they don't have
+func isMastodonEndpointMissing(err error) bool {
+	apierr, ok := err.(*mastodonAPIError)
+	return ok && (apierr.StatusCode == http.StatusNotFound || apierr.StatusCode == http.StatusMethodNotAllowed || apierr.StatusCode == http.StatusNotImplemented)
+}
+
+/// go-mastodon does not cover every API endpoint we need (yet), so we talk to those directly.
+/// Uses the same http.Client and the same credentials from [mastodon] as the go-mastodon client.
+func mastodonAPIRequest(ctx context.Context, client *mastodon.Client, method, uri string, params url.Values, res interface{}) error {
+	u, err := mastodonAPIURL(uri)
+	if err != nil {
+		return err
+	}
+
+	var req *http.Request
+	if method == http.MethodGet || params == nil {
+		if params != nil {
+			u.RawQuery = params.Encode()
+		}
+		req, err = http.NewRequest(method, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(method, u.String(), strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = mastodonAPIDo(ctx, client, req, uri, res)
+	return err
+}
+
+func mastodonAPIURL(uri string) (*url.URL, error) {
+	u, err := url.Parse(c["mastodon"]["server"])
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, uri)
+	return u, nil
+}
+
+/// send req with our credentials and decode the response into res. Returns the http status code on success.
+/// 202 and 206 mean the server is still working on it (e.g. processing media), we leave it to the caller to care.
+func mastodonAPIDo(ctx context.Context, client *mastodon.Client, req *http.Request, uri string, res interface{}) (int, error) {
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+c["mastodon"]["access_token"])
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusPartialContent {
+		errbody, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, &mastodonAPIError{Method: req.Method, URI: uri, Status: resp.Status, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(errbody))}
+	}
+	if res == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(res)
+}
+
+/// false if the instance has no streaming API or something between us and it breaks it
+func mastodonStreamingAvailable(ctx context.Context, client *mastodon.Client) bool {
+	return mastodonAPIRequest(ctx, client, http.MethodGet, "/api/v1/streaming/health", nil, nil) == nil
+}
+
+/// upload contents via /api/v2/media, streaming it without keeping it in memory. Videos and audio are processed asynchronously,
+/// so we wait until the instance is done, as PostStatus would fail with an unprocessed attachment.
+func mastodonUploadMedia(ctx context.Context, client *mastodon.Client, contents io.Reader, filename, mimetype, description string) (*mastodon.Attachment, error) {
+	u, err := mastodonAPIURL("/api/v2/media")
+	if err != nil {
+		return nil, err
+	}
+	body, bodywriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	mpwriter := multipart.NewWriter(bodywriter)
+	req.Header.Set("Content-Type", mpwriter.FormDataContentType())
+	/// if the request fails, the transport closes body and our writes fail too
+	go func() {
+		partheader := textproto.MIMEHeader{}
+		partheader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+		partheader.Set("Content-Type", mimetype)
+		part, err := mpwriter.CreatePart(partheader)
+		if err == nil {
+			_, err = io.Copy(part, contents)
+		}
+		if err == nil && len(description) > 0 {
+			err = mpwriter.WriteField("description", description)
+		}
+		if err == nil {
+			err = mpwriter.Close()
+		}
+		bodywriter.CloseWithError(err)
+	}()
+	var attachment mastodon.Attachment
+	statuscode, err := mastodonAPIDo(ctx, client, req, "/api/v2/media", &attachment)
+	if err != nil {
+		return nil, err
+	}
+	for try := 0; statuscode != http.StatusOK; try++ {
+		if try >= mastodon_media_processing_tries_ {
+			return nil, fmt.Errorf("instance still processing media %s, giving up", attachment.ID)
+		}
+		time.Sleep(mastodon_media_processing_wait_)
+		u, err = mastodonAPIURL(fmt.Sprintf("/api/v1/media/%s", attachment.ID))
+		if err != nil {
+			return nil, err
+		}
+		if req, err = http.NewRequest(http.MethodGet, u.String(), nil); err != nil {
+			return nil, err
+		}
+		if statuscode, err = mastodonAPIDo(ctx, client, req, "/api/v1/media/:id", &attachment); err != nil {
+			return nil, err
+		}
+	}
+	return &attachment, nil
+}
+
+/// the parameters client.PostStatus would send, but go-mastodon's Toot does not know about the language of a status or polls
+func mastodonTootParams(toot *mastodon.Toot, opts PostOptions) url.Values {
+	params := url.Values{}
+	params.Set("status", toot.Status)
+	if len(toot.InReplyToID) > 0 {
+		params.Set("in_reply_to_id", string(toot.InReplyToID))
+	}
+	for _, media := range toot.MediaIDs {
+		params.Add("media_ids[]", string(media))
+	}
+	if len(toot.Visibility) > 0 {
+		params.Set("visibility", toot.Visibility)
+	}
+	if toot.Sensitive {
+		params.Set("sensitive", "true")
+	}
+	if len(toot.SpoilerText) > 0 {
+		params.Set("spoiler_text", toot.SpoilerText)
+	}
+	if len(opts.Language) > 0 {
+		params.Set("language", opts.Language)
+	}
+	if opts.Poll != nil {
+		for _, option := range opts.Poll.Options {
+			params.Add("poll[options][]", option)
+		}
+		params.Set("poll[expires_in]", strconv.FormatInt(int64(opts.Poll.ExpiresIn/time.Second), 10))
+		if opts.Poll.Multiple {
+			params.Set("poll[multiple]", "true")
+		}
+		if opts.Poll.HideTotals {
+			params.Set("poll[hide_totals]", "true")
+		}
+	}
+	return params
+}
+
+func mastodonPostStatus(ctx context.Context, client *mastodon.Client, toot *mastodon.Toot, opts PostOptions) (*mastodon.Status, error) {
+	var status mastodon.Status
+	if err := mastodonAPIRequest(ctx, client, http.MethodPost, "/api/v1/statuses", mastodonTootParams(toot, opts), &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+type mastodonScheduledStatus struct {
+	ID          mastodon.ID `json:"id"`
+	ScheduledAt time.Time   `json:"scheduled_at"`
+}
+
+/// what we asked the instance to publish, so we can tell the status it became from anything else we posted meanwhile.
+/// Kept in [state]dir until we found it.
+type mastodonScheduledParams struct {
+	Text        string      `json:"text"`
+	SpoilerText string      `json:"spoiler_text"`
+	Visibility  string      `json:"visibility"` // empty for the accounts default
+	InReplyToID mastodon.ID `json:"in_reply_to_id"`
+	MediaCount  int         `json:"media_count"`
+}
+
+const mastodon_scheduled_params_filename_ string = "mastodonscheduled.json"
+
+var mastodon_scheduled_params_lock_ sync.Mutex
+var mastodon_scheduled_params_ map[mastodon.ID]mastodonScheduledParams
+
+/// call with mastodon_scheduled_params_lock_ held
+func loadMastodonScheduledParams() {
+	if mastodon_scheduled_params_ != nil {
+		return
+	}
+	mastodon_scheduled_params_ = make(map[mastodon.ID]mastodonScheduledParams)
+	loadStateFile(mastodon_scheduled_params_filename_, &mastodon_scheduled_params_)
+}
+
+func rememberMastodonScheduledParams(scheduledid mastodon.ID, params mastodonScheduledParams) {
+	mastodon_scheduled_params_lock_.Lock()
+	defer mastodon_scheduled_params_lock_.Unlock()
+	loadMastodonScheduledParams()
+	mastodon_scheduled_params_[scheduledid] = params
+	saveStateFile(mastodon_scheduled_params_filename_, mastodon_scheduled_params_)
+}
+
+func getMastodonScheduledParams(scheduledid mastodon.ID) (mastodonScheduledParams, bool) {
+	mastodon_scheduled_params_lock_.Lock()
+	defer mastodon_scheduled_params_lock_.Unlock()
+	loadMastodonScheduledParams()
+	params, inmap := mastodon_scheduled_params_[scheduledid]
+	return params, inmap
+}
+
+func forgetMastodonScheduledParams(scheduledid mastodon.ID) {
+	mastodon_scheduled_params_lock_.Lock()
+	defer mastodon_scheduled_params_lock_.Unlock()
+	loadMastodonScheduledParams()
+	if _, inmap := mastodon_scheduled_params_[scheduledid]; inmap {
+		delete(mastodon_scheduled_params_, scheduledid)
+		saveStateFile(mastodon_scheduled_params_filename_, mastodon_scheduled_params_)
+	}
+}
+
+/// let the instance publish toot at time at. Mastodon wants at to be at least 5 minutes in the future.
+func mastodonScheduleStatus(ctx context.Context, client *mastodon.Client, toot *mastodon.Toot, opts PostOptions, at time.Time) (mastodon.ID, error) {
+	params := mastodonTootParams(toot, opts)
+	params.Set("scheduled_at", at.UTC().Format(time.RFC3339))
+	var scheduled mastodonScheduledStatus
+	if err := mastodonAPIRequest(ctx, client, http.MethodPost, "/api/v1/statuses", params, &scheduled); err != nil {
+		return "", err
+	}
+	rememberMastodonScheduledParams(scheduled.ID, mastodonScheduledParams{
+		Text:        toot.Status,
+		SpoilerText: toot.SpoilerText,
+		Visibility:  toot.Visibility,
+		InReplyToID: toot.InReplyToID,
+		MediaCount:  len(toot.MediaIDs),
+	})
+	return scheduled.ID, nil
+}
+
+func mastodonCancelScheduledStatus(ctx context.Context, client *mastodon.Client, scheduledid mastodon.ID) error {
+	err := mastodonAPIRequest(ctx, client, http.MethodDelete, fmt.Sprintf("/api/v1/scheduled_statuses/%s", scheduledid), nil, nil)
+	if err == nil || isMastodonNotFound(err) {
+		forgetMastodonScheduledParams(scheduledid)
+	}
+	return err
+}
+
+type mastodonPollOption struct {
+	Title      string `json:"title"`
+	VotesCount *int   `json:"votes_count"` // null while totals are hidden
+}
+
+type mastodonPoll struct {
+	ID          mastodon.ID          `json:"id"`
+	ExpiresAt   *time.Time           `json:"expires_at"`
+	Expired     bool                 `json:"expired"`
+	Multiple    bool                 `json:"multiple"`
+	VotesCount  int                  `json:"votes_count"`
+	VotersCount *int                 `json:"voters_count"`
+	Options     []mastodonPollOption `json:"options"`
+}
+
+/// the poll of status statusid, nil if it has none
+func mastodonGetStatusPoll(ctx context.Context, client *mastodon.Client, statusid mastodon.ID) (*mastodonPoll, error) {
+	var status struct {
+		Poll *mastodonPoll `json:"poll"`
+	}
+	if err := mastodonAPIRequest(ctx, client, http.MethodGet, fmt.Sprintf("/api/v1/statuses/%s", statusid), nil, &status); err != nil {
+		return nil, err
+	}
+	return status.Poll, nil
+}
+
+/// scheduled statuses vanish once the instance published them and nothing tells us which status they became.
+/// So look through our own recent statuses published around at for the one with the text, content warning, visibility,
+/// reply target and number of attachments we scheduled. Rather than guess, we give up if that is not exactly one.
+func mastodonFindPublishedScheduledStatus(ctx context.Context, client *mastodon.Client, scheduledid mastodon.ID, at time.Time) (statusid mastodon.ID, err error) {
+	err = mastodonAPIRequest(ctx, client, http.MethodGet, fmt.Sprintf("/api/v1/scheduled_statuses/%s", scheduledid), nil, nil)
+	if err == nil {
+		return "", nil // still waiting to be published
+	}
+	if !isMastodonNotFound(err) {
+		forgetMastodonScheduledParams(scheduledid) // nobody asks again
+		return "", err
+	}
+	expected, known := getMastodonScheduledParams(scheduledid)
+	if !known {
+		return "", fmt.Errorf("scheduled status %s was published, but we don't know what it looked like", scheduledid)
+	}
+	defer forgetMastodonScheduledParams(scheduledid)
+	my_account, err := client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return "", err
+	}
+	statuses, err := client.GetAccountStatuses(ctx, my_account.ID, &mastodon.Pagination{Limit: 40})
+	if err != nil {
+		return "", err
+	}
+	var matches []mastodon.ID
+	for _, status := range statuses {
+		if status.Reblog != nil || status.SpoilerText != expected.SpoilerText || len(status.MediaAttachments) != expected.MediaCount {
+			continue
+		}
+		if len(expected.Visibility) > 0 && status.Visibility != expected.Visibility {
+			continue
+		}
+		if inreplyto, _ := status.InReplyToID.(string); mastodon.ID(inreplyto) != expected.InReplyToID {
+			continue
+		}
+		if status.CreatedAt.Before(at.Add(-time.Minute)) || status.CreatedAt.After(at.Add(15*time.Minute)) {
+			continue
+		}
+		if normalizeStatusText(mastodonStatusSourceText(ctx, client, status)) != normalizeStatusText(expected.Text) {
+			continue
+		}
+		matches = append(matches, status.ID)
+	}
+	if len(matches) != 1 {
+		log.Printf("mastodonFindPublishedScheduledStatus: %d statuses look like scheduled status %s: %v", len(matches), scheduledid, matches)
+		return "", fmt.Errorf("scheduled status %s was published, but %d statuses look like it", scheduledid, len(matches))
+	}
+	return matches[0], nil
+}
+
+/// the text status was written with, or its content without HTML if the instance is too old to tell
+func mastodonStatusSourceText(ctx context.Context, client *mastodon.Client, status *mastodon.Status) string {
+	var source struct {
+		Text string `json:"text"`
+	}
+	if err := mastodonAPIRequest(ctx, client, http.MethodGet, fmt.Sprintf("/api/v1/statuses/%s/source", status.ID), nil, &source); err == nil {
+		return source.Text
+	}
+	content := strings.NewReplacer("<br>", "\n", "<br />", "\n", "<br/>", "\n", "</p>", "\n").Replace(status.Content)
+	return html.UnescapeString(bluemonday.StrictPolicy().Sanitize(content))
+}
+
+/// ignore differences in whitespace
+func normalizeStatusText(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
+
+/// edit oldstatus in place, keeping its attachments and language
+func mastodonEditStatus(ctx context.Context, client *mastodon.Client, oldstatus *mastodon.Status, post string, opts PostOptions) (*mastodon.Status, error) {
+	params := url.Values{}
+	params.Set("status", post)
+	for _, attachment := range oldstatus.MediaAttachments {
+		params.Add("media_ids[]", string(attachment.ID))
+	}
+	if len(opts.SpoilerText) > 0 {
+		params.Set("spoiler_text", opts.SpoilerText)
+	}
+	if opts.Sensitive {
+		params.Set("sensitive", "true")
+	}
+	if len(opts.Language) > 0 {
+		params.Set("language", opts.Language)
+	} else if len(oldstatus.Language) > 0 {
+		params.Set("language", oldstatus.Language)
+	}
+	var status mastodon.Status
+	if err := mastodonAPIRequest(ctx, client, http.MethodPut, fmt.Sprintf("/api/v1/statuses/%s", oldstatus.ID), params, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+/// what /api/v2/instance or /api/v1/instance tell us about the limits of the server
+/// Pleroma and Akkoma only have the v1 endpoint and tell us about their limits in their own fields.
+type mastodonInstanceInfo struct {
+	Configuration struct {
+		Statuses struct {
+			MaxCharacters            int `json:"max_characters"`
+			MaxMediaAttachments      int `json:"max_media_attachments"`
+			CharactersReservedPerURL int `json:"characters_reserved_per_url"`
+		} `json:"statuses"`
+		MediaAttachments struct {
+			SupportedMimeTypes []string `json:"supported_mime_types"`
+			ImageSizeLimit     int64    `json:"image_size_limit"`
+			ImageMatrixLimit   int64    `json:"image_matrix_limit"`
+			VideoSizeLimit     int64    `json:"video_size_limit"`
+		} `json:"media_attachments"`
+		Polls struct {
+			MaxOptions             int   `json:"max_options"`
+			MaxCharactersPerOption int   `json:"max_characters_per_option"`
+			MinExpiration          int64 `json:"min_expiration"`
+			MaxExpiration          int64 `json:"max_expiration"`
+		} `json:"polls"`
+	} `json:"configuration"`
+	MaxTootChars int   `json:"max_toot_chars"`
+	UploadLimit  int64 `json:"upload_limit"`
+}
+
+type MastodonInstanceLimits struct {
+	MaxCharacters            int
+	MaxMediaAttachments      int
+	CharactersReservedPerURL int
+	ImageSizeLimit           int64
+	ImagePixelLimit          int64
+	VideoSizeLimit           int64 // also for audio
+	SupportedMimeTypes       []string
+	PollMaxOptions           int
+	PollMaxCharsPerOption    int
+	PollMinExpiration        time.Duration
+	PollMaxExpiration        time.Duration
+}
+
+/// fetch limits of our instance. Anything the server does not tell us is left at the value in limits.
+func mastodonGetInstanceLimits(ctx context.Context, client *mastodon.Client, limits MastodonInstanceLimits) (MastodonInstanceLimits, error) {
+	var info mastodonInstanceInfo
+	if err := mastodonAPIRequest(ctx, client, http.MethodGet, "/api/v2/instance", nil, &info); err != nil {
+		info = mastodonInstanceInfo{}
+		if err = mastodonAPIRequest(ctx, client, http.MethodGet, "/api/v1/instance", nil, &info); err != nil {
+			return limits, err
+		}
+	}
+	statuses := info.Configuration.Statuses
+	media := info.Configuration.MediaAttachments
+	if statuses.MaxCharacters > 0 {
+		limits.MaxCharacters = statuses.MaxCharacters
+	} else if info.MaxTootChars > 0 {
+		limits.MaxCharacters = info.MaxTootChars
+	}
+	if statuses.MaxMediaAttachments > 0 {
+		limits.MaxMediaAttachments = statuses.MaxMediaAttachments
+	}
+	if statuses.CharactersReservedPerURL > 0 {
+		limits.CharactersReservedPerURL = statuses.CharactersReservedPerURL
+	}
+	polls := info.Configuration.Polls
+	if polls.MaxOptions > 0 {
+		limits.PollMaxOptions = polls.MaxOptions
+	}
+	if polls.MaxCharactersPerOption > 0 {
+		limits.PollMaxCharsPerOption = polls.MaxCharactersPerOption
+	}
+	if polls.MinExpiration > 0 {
+		limits.PollMinExpiration = time.Duration(polls.MinExpiration) * time.Second
+	}
+	if polls.MaxExpiration > 0 {
+		limits.PollMaxExpiration = time.Duration(polls.MaxExpiration) * time.Second
+	}
+	if media.VideoSizeLimit > 0 {
+		limits.VideoSizeLimit = media.VideoSizeLimit
+	} else if info.UploadLimit > 0 {
+		limits.VideoSizeLimit = info.UploadLimit
+	}
+	if len(media.SupportedMimeTypes) > 0 {
+		limits.SupportedMimeTypes = media.SupportedMimeTypes
+	}
+	if media.ImageMatrixLimit > 0 {
+		limits.ImagePixelLimit = media.ImageMatrixLimit
+	}
+	if media.ImageSizeLimit > 0 {
+		limits.ImageSizeLimit = media.ImageSizeLimit
+	} else if info.UploadLimit > 0 {
+		limits.ImageSizeLimit = info.UploadLimit
+	}
+	return limits, nil
+}
@@ -15,6 +15,7 @@ type FeedRoomConnector struct {
 	tclient        *anaconda.TwitterApi
 	mxcli          *gomatrix.Client
 	mxlinkupload_c chan<- MxContentUrlFuture
+	rums_store_c   chan<- RUMSStoreMsg
 }
 
 type StatusFilterConfig struct {
@@ -31,35 +32,6 @@ type StatusFilterConfig struct {
 	must_not_be_sensitive      bool
 }
 
-func (frc *FeedRoomConnector) runSplitMastodonEventStream(evChan <-chan mastodon.Event, statusOutChan chan<- *mastodon.Status, notificationOutChan chan<- *mastodon.Notification) {
-	for eventi := range evChan {
-		switch event := eventi.(type) {
-		case *mastodon.ErrorEvent:
-			log.Println("runSplitMastodonEventStream:", "Error event:", event.Error())
-			//in case of error like a network error
-			//we really probably don't want fancy error handling only to fail at a later stage
-			//when network outage continues...
-			//thus we panic and exit early, leaving it to the service handler to restart us later
-			//for now
-			panic(event.Error())
-		case *mastodon.UpdateEvent:
-			if statusOutChan != nil {
-				statusOutChan <- event.Status
-			}
-			// log.Println("runSplitMastodonEventStream: new Status", event.Status)
-		case *mastodon.NotificationEvent:
-			if notificationOutChan != nil {
-				notificationOutChan <- event.Notification
-			}
-			// log.Println("runSplitMastodonEventStream: new Notification", event.Notification)
-		case *mastodon.DeleteEvent:
-			continue
-		default:
-			log.Println("runSplitMastodonEventStream:", "Unhandled event:", eventi)
-		}
-	}
-}
-
 func (frc *FeedRoomConnector) taskJoinStatusStreams(statusOutChan chan<- *mastodon.Status) (statusOutChan1 <-chan *mastodon.Status, statusOutChan2 <-chan *mastodon.Status) {
 	statusOutChan1 = make(chan *mastodon.Status, 42)
 	statusOutChan2 = make(chan *mastodon.Status, 42)
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btittelbach/cachetable"
+	mastodon "github.com/mattn/go-mastodon"
+)
+
+/// The streaming API drops connections whenever the instance or the network hiccups. We reconnect with exponential backoff
+/// and fetch what the stream would have brought meanwhile from the timeline and notifications, oldest first.
+/// Each source remembers what it passed on lately, so nothing arriving by both ways is passed on twice.
+/// With [feed2matrix]updates=poll, or with updates=auto if the instance's streaming API does not work, we only ever do the latter,
+/// every poll_interval seconds.
+
+const mastodon_stream_backoff_min_ time.Duration = 2 * time.Second
+const mastodon_stream_backoff_max_ time.Duration = 5 * time.Minute
+const mastodon_stream_healthy_after_ time.Duration = time.Minute // a connection lasting this long resets the backoff
+const mastodon_stream_max_failures_ int = 5                      // with updates=auto, poll after this many useless connections in a row
+const mastodon_backfill_max_pages_ int = 10
+const mastodon_backfill_page_size_ int64 = 40
+
+/// a mastodon stream and the timeline to fill its gaps from
+type MastodonStreamSource struct {
+	name          string
+	connect       func(ctx context.Context) (chan mastodon.Event, error)
+	timeline      func(ctx context.Context, pg *mastodon.Pagination) ([]*mastodon.Status, error)
+	notifications bool // the user stream also brings our notifications
+}
+
+func mastodonHomeStreamSource(mclient *mastodon.Client) MastodonStreamSource {
+	return MastodonStreamSource{name: "home", connect: mclient.StreamingUser, timeline: mclient.GetTimelineHome, notifications: true}
+}
+
+func mastodonTagStreamSource(mclient *mastodon.Client, tag string) MastodonStreamSource {
+	return MastodonStreamSource{
+		name: "#" + tag,
+		connect: func(ctx context.Context) (chan mastodon.Event, error) {
+			return mclient.StreamingHashtag(ctx, tag, false)
+		},
+		timeline: func(ctx context.Context, pg *mastodon.Pagination) ([]*mastodon.Status, error) {
+			return mclient.GetTimelineHashtag(ctx, tag, false, pg)
+		},
+	}
+}
+
+/// true if mastodon id a is newer than b. IDs are numbers of varying length, so a plain string comparison won't do.
+func mastodonIDNewer(a, b mastodon.ID) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+/// how far a source got: the newest ids passed on, and which ones we passed on lately
+type mastodonStreamPosition struct {
+	seen              *cachetable.CacheTable
+	last_status       mastodon.ID
+	last_notification mastodon.ID
+}
+
+func newMastodonStreamPosition() *mastodonStreamPosition {
+	seen, err := cachetable.NewCacheTable(64, 16, false)
+	if err != nil {
+		panic(err)
+	}
+	return &mastodonStreamPosition{seen: seen}
+}
+
+/// true the first time key comes by
+func (pos *mastodonStreamPosition) firstSeen(key string) bool {
+	if _, inmap := pos.seen.Get(key); inmap {
+		return false
+	}
+	pos.seen.Set(key, true)
+	return true
+}
+
+func (pos *mastodonStreamPosition) passStatus(status *mastodon.Status, statusOutChan chan<- *mastodon.Status) {
+	if mastodonIDNewer(status.ID, pos.last_status) {
+		pos.last_status = status.ID
+	}
+	if statusOutChan != nil && pos.firstSeen("status:"+string(status.ID)) {
+		statusOutChan <- status
+	}
+}
+
+func (pos *mastodonStreamPosition) passNotification(notification *mastodon.Notification, notificationOutChan chan<- *mastodon.Notification) {
+	if mastodonIDNewer(notification.ID, pos.last_notification) {
+		pos.last_notification = notification.ID
+	}
+	if notificationOutChan != nil && pos.firstSeen("notification:"+string(notification.ID)) {
+		notificationOutChan <- notification
+	}
+}
+
+/// split source into statuses and notifications, forever. Never gives up, whatever the instance does.
+func (frc *FeedRoomConnector) runSplitMastodonEventStream(source MastodonStreamSource, statusOutChan chan<- *mastodon.Status, notificationOutChan chan<- *mastodon.Notification) {
+	pos := newMastodonStreamPosition()
+	frc.markMastodonStreamStart(source, pos, notificationOutChan != nil)
+	if mastodon_updates_ == "poll" {
+		frc.runPollMastodonSource(source, pos, statusOutChan, notificationOutChan)
+	}
+	if mastodon_updates_ == "auto" && !mastodonStreamingAvailable(context.Background(), frc.mclient) {
+		log.Printf("runSplitMastodonEventStream: %s: streaming API unavailable, polling every %s instead", source.name, mastodon_poll_interval_)
+		frc.runPollMastodonSource(source, pos, statusOutChan, notificationOutChan)
+	}
+	backoff := mastodon_stream_backoff_min_
+	failures := 0 // connections in a row that neither lasted nor brought anything
+	for reconnect := false; ; reconnect = true {
+		ctx, cancel := context.WithCancel(context.Background())
+		evChan, err := source.connect(ctx)
+		failures++
+		if err == nil {
+			if reconnect {
+				frc.backfillMastodonStream(ctx, source, pos, statusOutChan, notificationOutChan)
+			}
+			connected := time.Now()
+			var numevents int
+			numevents, err = splitMastodonEvents(evChan, pos, statusOutChan, notificationOutChan)
+			if time.Since(connected) > mastodon_stream_healthy_after_ {
+				backoff = mastodon_stream_backoff_min_
+			}
+			if numevents > 0 || time.Since(connected) > mastodon_stream_healthy_after_ {
+				failures = 0
+			}
+			/// go-mastodon keeps trying to send into evChan until it notices ctx is done
+			go func() {
+				for range evChan {
+				}
+			}()
+		}
+		cancel()
+		if mastodon_updates_ == "auto" && failures >= mastodon_stream_max_failures_ {
+			log.Printf("runSplitMastodonEventStream: %s: %s, streaming keeps failing, polling every %s instead", source.name, err, mastodon_poll_interval_)
+			frc.runPollMastodonSource(source, pos, statusOutChan, notificationOutChan)
+		}
+		log.Printf("runSplitMastodonEventStream: %s: %s, reconnecting in %s", source.name, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > mastodon_stream_backoff_max_ {
+			backoff = mastodon_stream_backoff_max_
+		}
+	}
+}
+
+/// go-mastodon also sends an ErrorEvent for a single event it could not decode, while the stream goes on.
+/// It does not let us at the error itself, so we have to tell by the message what encoding/json says.
+func isMastodonStreamDecodeError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "json: ") || strings.HasPrefix(msg, "invalid character ") || strings.HasPrefix(msg, "parsing time ") ||
+		msg == "unexpected end of JSON input"
+}
+
+/// pass on events until the stream reports it lost the connection. Returns how many events there were.
+func splitMastodonEvents(evChan <-chan mastodon.Event, pos *mastodonStreamPosition, statusOutChan chan<- *mastodon.Status, notificationOutChan chan<- *mastodon.Notification) (int, error) {
+	numevents := 0
+	for eventi := range evChan {
+		switch event := eventi.(type) {
+		case *mastodon.ErrorEvent:
+			if isMastodonStreamDecodeError(event) {
+				log.Println("runSplitMastodonEventStream:", "skipping event we can't read:", event.Error())
+				continue
+			}
+			return numevents, event
+		case *mastodon.UpdateEvent:
+			pos.passStatus(event.Status, statusOutChan)
+		case *mastodon.NotificationEvent:
+			pos.passNotification(event.Notification, notificationOutChan)
+		case *mastodon.DeleteEvent:
+			continue
+		default:
+			log.Println("runSplitMastodonEventStream:", "Unhandled event:", eventi)
+		}
+		numevents++
+	}
+	return numevents, fmt.Errorf("stream closed")
+}
+
+/// instead of streaming, fetch what is new every mastodon_poll_interval_, forever
+func (frc *FeedRoomConnector) runPollMastodonSource(source MastodonStreamSource, pos *mastodonStreamPosition, statusOutChan chan<- *mastodon.Status, notificationOutChan chan<- *mastodon.Notification) {
+	for {
+		frc.markMastodonStreamStart(source, pos, notificationOutChan != nil)
+		frc.backfillMastodonStream(context.Background(), source, pos, statusOutChan, notificationOutChan)
+		time.Sleep(mastodon_poll_interval_)
+	}
+}
+
+/// remember the newest status and notification there are now, so we know where to backfill from even if the stream
+/// drops before it brought anything. "0" if there are none yet, so everything that comes counts as new.
+/// Leaves alone what it already knows and tries again next time if the instance does not answer.
+func (frc *FeedRoomConnector) markMastodonStreamStart(source MastodonStreamSource, pos *mastodonStreamPosition, withnotifications bool) {
+	if len(pos.last_status) == 0 {
+		if statuses, err := source.timeline(context.Background(), &mastodon.Pagination{Limit: 1}); err != nil {
+			log.Printf("runSplitMastodonEventStream: %s: %s", source.name, err)
+		} else if len(statuses) > 0 {
+			pos.last_status = statuses[0].ID
+		} else {
+			pos.last_status = "0"
+		}
+	}
+	if !source.notifications || !withnotifications || len(pos.last_notification) > 0 {
+		return
+	}
+	if notifications, err := frc.mclient.GetNotifications(context.Background(), &mastodon.Pagination{Limit: 1}); err != nil {
+		log.Printf("runSplitMastodonEventStream: %s: %s", source.name, err)
+	} else if len(notifications) > 0 {
+		pos.last_notification = notifications[0].ID
+	} else {
+		pos.last_notification = "0"
+	}
+}
+
+/// pass on what came in since the last status and notification we saw
+func (frc *FeedRoomConnector) backfillMastodonStream(ctx context.Context, source MastodonStreamSource, pos *mastodonStreamPosition, statusOutChan chan<- *mastodon.Status, notificationOutChan chan<- *mastodon.Notification) {
+	if len(pos.last_status) > 0 {
+		statuses, err := fetchMastodonStatusesSince(ctx, source.timeline, pos.last_status)
+		if err != nil {
+			log.Printf("backfillMastodonStream: %s: %s", source.name, err)
+		}
+		if len(statuses) > 0 {
+			log.Printf("backfillMastodonStream: %s: %d statuses since %s", source.name, len(statuses), pos.last_status)
+		}
+		for _, status := range statuses {
+			pos.passStatus(status, statusOutChan)
+		}
+	}
+	if source.notifications && notificationOutChan != nil && len(pos.last_notification) > 0 {
+		notifications, err := fetchMastodonNotificationsSince(ctx, frc.mclient, pos.last_notification)
+		if err != nil {
+			log.Printf("backfillMastodonStream: %s: %s", source.name, err)
+		}
+		for _, notification := range notifications {
+			pos.passNotification(notification, notificationOutChan)
+		}
+	}
+}
+
+/// page through everything newer than since, at most mastodon_backfill_max_pages_ pages.
+/// fetchpage fetches one page, keeps what it got and returns the ids on it. Stops at the first error and returns it.
+func pageMastodonSince(since mastodon.ID, fetchpage func(*mastodon.Pagination) ([]mastodon.ID, error)) error {
+	for page := 0; page < mastodon_backfill_max_pages_; page++ {
+		ids, err := fetchpage(&mastodon.Pagination{MinID: since, Limit: mastodon_backfill_page_size_})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if mastodonIDNewer(id, since) {
+				since = id
+			}
+		}
+		if int64(len(ids)) < mastodon_backfill_page_size_ {
+			return nil
+		}
+	}
+	return nil
+}
+
+/// sort slice oldest first, by the id of each element
+func sortMastodonOldestFirst(slice interface{}, id func(idx int) mastodon.ID) {
+	sort.SliceStable(slice, func(i, j int) bool { return mastodonIDNewer(id(j), id(i)) })
+}
+
+/// everything newer than since, oldest first. On error returns what it got so far.
+func fetchMastodonStatusesSince(ctx context.Context, timeline func(context.Context, *mastodon.Pagination) ([]*mastodon.Status, error), since mastodon.ID) ([]*mastodon.Status, error) {
+	var fetched []*mastodon.Status
+	err := pageMastodonSince(since, func(pg *mastodon.Pagination) ([]mastodon.ID, error) {
+		statuses, err := timeline(ctx, pg)
+		ids := make([]mastodon.ID, len(statuses))
+		for idx, status := range statuses {
+			ids[idx] = status.ID
+		}
+		fetched = append(fetched, statuses...)
+		return ids, err
+	})
+	sortMastodonOldestFirst(fetched, func(idx int) mastodon.ID { return fetched[idx].ID })
+	return fetched, err
+}
+
+/// like fetchMastodonStatusesSince, for notifications
+func fetchMastodonNotificationsSince(ctx context.Context, mclient *mastodon.Client, since mastodon.ID) ([]*mastodon.Notification, error) {
+	var fetched []*mastodon.Notification
+	err := pageMastodonSince(since, func(pg *mastodon.Pagination) ([]mastodon.ID, error) {
+		notifications, err := mclient.GetNotifications(ctx, pg)
+		ids := make([]mastodon.ID, len(notifications))
+		for idx, notification := range notifications {
+			ids[idx] = notification.ID
+		}
+		fetched = append(fetched, notifications...)
+		return ids, err
+	})
+	sortMastodonOldestFirst(fetched, func(idx int) mastodon.ID { return fetched[idx].ID })
+	return fetched, err
+}
@@ -24,6 +24,13 @@ var (
 	twitter_status_uri_re_  *regexp.Regexp
 )
 
+/// in case the client does not tell us
+var mx_default_mimetypes_ = map[string]string{
+	"m.image": "image/jpeg",
+	"m.video": "video/mp4",
+	"m.audio": "audio/mpeg",
+}
+
 func init() {
 	mastodon_status_uri_re_ = regexp.MustCompile(`^https?://[^/]+/@\w+/(\d+)$`)
 	twitter_status_uri_re_ = regexp.MustCompile(`^https?://twitter\.com/.+/status(?:es)?/(\d+)$`)
@@ -34,14 +41,23 @@ func mxNotify(client *gomatrix.Client, from, msg string) {
 	client.SendText(c["matrix"]["room_id"], msg)
 }
 
+/// like mxNotify, but as reply to eventid
+func mxNotifyReply(client *gomatrix.Client, from, msg, eventid string) {
+	log.Printf("%s: %s\n", from, msg)
+	client.SendMessageEvent(c["matrix"]["room_id"], "m.room.message", MxReplyMessage{
+		MsgType:   "m.text",
+		Body:      msg,
+		RelatesTo: MxRelatesTo{InReplyTo: &MxInReplyTo{EventID: eventid}},
+	})
+}
+
 // Ignore messages from ourselves
 // Ignore messages from rooms we are not interessted in
 func mxIgnoreEvent(ev *gomatrix.Event) bool {
-	return ev.Sender == c["matrix"]["user"] || ev.RoomID != c["matrix"]["room_id"]
+	return ev.Sender == mx_user_id_ || ev.RoomID != c["matrix"]["room_id"]
 }
 
-type mastodon_action_cmd func(string) error
-type twitter_action_cmd func(string) error
+type publisher_action_cmd func(Publisher, string) error
 
 //TODO: accept strings in form:
 // ✓ url (where we can detect twitter or mastodon)
@@ -50,7 +66,7 @@ type twitter_action_cmd func(string) error
 // ✓ "tweet <ID>" --> twitter
 // ✓ "birdsite <ID>" --> twitter
 // - last --> favourite the last received toot or tweet
-func parseReblogFavouriteArgs(prefix, line string, mxcli *gomatrix.Client, mcmd mastodon_action_cmd, tcmd twitter_action_cmd) error {
+func parseReblogFavouriteArgs(prefix, line string, mxcli *gomatrix.Client, cmd publisher_action_cmd) error {
 	tort := ""
 	statusidstr := ""
 	args := strings.SplitN(strings.ToLower(strings.TrimSpace(line[len(prefix):])), " ", 3)
@@ -75,47 +91,304 @@ func parseReblogFavouriteArgs(prefix, line string, mxcli *gomatrix.Client, mcmd
 			statusidstr = matchlist[1]
 		}
 	}
-	/// now execute
-	switch tort {
-	case twitter_net:
-		return tcmd(statusidstr)
-	case mastodon_net:
-		return mcmd(statusidstr)
-	default:
+	if len(tort) == 0 {
 		return fmt.Errorf("Please say " + prefix + " followed by 'last', <status URL> or 'toot'/'tweet' <ID>")
 	}
+	/// now execute
+	p, err := getPublisherOrError(tort)
+	if err != nil {
+		return err
+	}
+	return cmd(p, statusidstr)
 }
 
-func runMatrixPublishBot() {
-	mxcli, _ := gomatrix.NewClient(c["matrix"]["url"], "", "")
-	resp, err := mxcli.Login(&gomatrix.ReqLogin{
-		Type:     "m.login.password",
-		User:     c["matrix"]["user"],
-		Password: c["matrix"]["password"],
-	})
+/// opts for replying to replyto_ptr on p. False if we can't reply there.
+func replyOpts(p Publisher, opts PostOptions, replyto_ptr *MsgStatusData) (PostOptions, bool) {
+	opts.InReplyTo = replyto_ptr.LastStatusID(p.Name())
+	opts.ReplyToMirrored = replyto_ptr.Action == actionMirror
+	return opts, !opts.ReplyToMirrored || len(opts.InReplyTo) > 0
+}
 
+/// like checkPostLength, once we know what post replies to, as replies may carry mentions
+func checkReplyLength(post string, postopts PostOptions, publishers []Publisher, replyto_ptr *MsgStatusData) error {
+	for _, p := range publishers {
+		if opts, canreply := replyOpts(p, postopts, replyto_ptr); canreply {
+			if err := checkPostLength(post, opts, []Publisher{p}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/// post to each of publishers, fill rums with the resulting status ids and tell the room how it went.
+/// Images queued by medianick are attached.
+func publishPost(mxcli *gomatrix.Client, markseen_c chan<- mastodon.ID, publishers []Publisher, eventid, medianick, post string, postopts PostOptions, replyto_ptr *MsgStatusData, rums *MsgStatusData) (failed bool) {
+	for _, p := range publishers {
+		opts := postopts
+		if err := p.Accepts(opts); err != nil {
+			mxNotify(mxcli, p.Name(), fmt.Sprintf("Not sending a %s: %s", p.StatusNoun(), err.Error()))
+			continue
+		}
+		if replyto_ptr != nil {
+			var canreply bool
+			if opts, canreply = replyOpts(p, postopts, replyto_ptr); !canreply {
+				// a reply to someone elses status makes no sense on networks the status isn't on
+				mxNotify(mxcli, p.Name(), fmt.Sprintf("Not sending a %s, since that status is not on %s", p.StatusNoun(), p.Name()))
+				continue
+			}
+		}
+		reviewurl, statusids, err := publishThread(p, post, medianick, opts)
+		if p.Name() == mastodon_net && markseen_c != nil {
+			for _, statusid := range statusids {
+				markseen_c <- mastodon.ID(statusid)
+			}
+		}
+		if len(statusids) > 0 {
+			rums.StatusIDs[p.Name()] = statusids[0]
+		}
+		if len(statusids) > 1 {
+			rums.ThreadStatusIDs[p.Name()] = statusids[1:]
+		}
+		if err != nil {
+			failed = true
+			log.Printf("%s PostERROR: %s", p.Name(), err)
+			if len(statusids) > 0 {
+				mxNotifyStatus(mxcli, p.Name(), fmt.Sprintf("ERROR while sending %s! Only %d parts of the thread made it: %s", p.StatusNoun(), len(statusids), reviewurl), eventid, *rums, p.Name(), reviewurl)
+			} else {
+				mxNotify(mxcli, p.Name(), fmt.Sprintf("ERROR while sending %s!", p.StatusNoun()))
+			}
+			continue
+		}
+		mxNotifyStatus(mxcli, p.Name(), fmt.Sprintf("sent %s! %s", p.StatusNoun(), reviewurl), eventid, *rums, p.Name(), reviewurl)
+	}
+	return
+}
+
+/// schedule_cmd followed by "list", "cancel <number>" or a time and a post (optionally starting with a profile prefix)
+func handleScheduleCommand(mxcli *gomatrix.Client, scheduler *PostScheduler, ev *gomatrix.Event, line string) error {
+	args := strings.TrimSpace(line[len(schedule_cmd_):])
+	argfields := strings.Fields(args)
+	if len(argfields) == 0 {
+		return fmt.Errorf("Please say " + schedule_cmd_ + " followed by 'list', 'cancel <number>' or a time and your post")
+	}
+	switch strings.ToLower(argfields[0]) {
+	case "list":
+		scheduled := scheduler.List()
+		if len(scheduled) == 0 {
+			mxNotify(mxcli, "schedule", "Nothing scheduled")
+			return nil
+		}
+		lines := make([]string, len(scheduled))
+		for idx := range scheduled {
+			lines[idx] = scheduled[idx].String()
+		}
+		mxNotify(mxcli, "schedule", strings.Join(lines, "\n"))
+		return nil
+	case "cancel":
+		if len(argfields) != 2 {
+			return fmt.Errorf("Please say " + schedule_cmd_ + " cancel <number>")
+		}
+		number, err := strconv.Atoi(strings.TrimPrefix(argfields[1], "#"))
+		if err != nil {
+			return err
+		}
+		sp, found := scheduler.GetByNumber(number)
+		if !found {
+			return fmt.Errorf("Nothing scheduled as #%d", number)
+		}
+		if sp.MatrixUser != ev.Sender && c.GetValueDefault("matrix", "admins_can_redact_user_status", "false") != "true" {
+			return fmt.Errorf("Won't cancel other users posts for you!")
+		}
+		if err = scheduler.Cancel(sp.EventID); err != nil {
+			return err
+		}
+		mxNotify(mxcli, "schedule", fmt.Sprintf("Ok, cancelled #%d", number))
+		return nil
+	}
+
+	now := time.Now()
+	at, text, err := parseScheduleTime(args, now)
 	if err != nil {
+		return err
+	}
+	if !at.After(now) {
+		return fmt.Errorf("%s is in the past", at.In(schedule_location_).Format("2006-01-02 15:04"))
+	}
+	profile := matchPostingProfile(text)
+	var post string
+	var opts PostOptions
+	if profile != nil {
+		post, opts, err = profile.ParsePost(text)
+	} else {
+		profile = getDefaultPostingProfile()
+		post, opts, err = profile.ParseText(text)
+	}
+	if err != nil {
+		return err
+	}
+	if len(post) == 0 {
+		return fmt.Errorf("Nothing to post")
+	}
+	publishers := profile.Publishers()
+	if err = checkPostLength(post, opts, publishers); err != nil {
+		return err
+	}
+
+	lock := getPerUserLock(ev.Sender)
+	lock.Lock()
+	defer lock.Unlock()
+	hasmedia := false
+	if c.GetValueDefault("images", "enabled", "false") == "true" {
+		queued, _ := getQueuedMedia(ev.Sender)
+		hasmedia = len(queued) > 0
+	}
+	sp := ScheduledPost{EventID: ev.ID, MatrixUser: ev.Sender, Due: at, Text: post, Options: opts, NativeIDs: make(map[string]string, 1)}
+	for _, p := range publishers {
+		if err := p.Accepts(opts); err != nil {
+			mxNotify(mxcli, p.Name(), fmt.Sprintf("Not scheduling a %s: %s", p.StatusNoun(), err.Error()))
+			continue
+		}
+		/// let the network do it if it can, unless we'd have to split the post into a thread
+		if scheduler, canschedule := p.(StatusScheduler); canschedule {
+			if ptext, reserved := p.PrepareText(post, opts); p.CountCharacters(ptext)+reserved <= p.CharacterLimit() {
+				scheduledid, err := scheduler.Schedule(ptext, ev.Sender, opts, at)
+				if err == nil {
+					sp.NativeIDs[p.Name()] = scheduledid
+					continue
+				}
+				log.Printf("%s could not schedule, doing it ourselves: %s", p.Name(), err)
+			}
+		}
+		sp.Networks = append(sp.Networks, p.Name())
+	}
+	if len(sp.Networks) == 0 && len(sp.NativeIDs) == 0 {
+		return fmt.Errorf("Nowhere to post to")
+	}
+	sp.HasMedia = hasmedia && len(sp.Networks) > 0
+	sp = scheduler.Add(sp)
+	if hasmedia && !sp.HasMedia {
+		media_store_.RemoveAll(ev.Sender) // already uploaded to networks scheduling on their own
+	}
+	msg := "Ok, scheduled " + sp.String()
+	if len(state_dir_) == 0 && len(sp.Networks) > 0 {
+		msg += fmt.Sprintf(". Set [state]dir or it won't survive a restart on %s", strings.Join(sp.Networks, ", "))
+	}
+	mxNotify(mxcli, "schedule", msg)
+	return nil
+}
+
+/// publish a post whose time has come and remember it like any other post, so redacting the schedule message deletes it.
+/// networkdone is called as soon as a network is done with it.
+func publishScheduledPost(mxcli *gomatrix.Client, markseen_c chan<- mastodon.ID, rums_store_chan chan<- RUMSStoreMsg, sp ScheduledPost, networkdone func(network string, rums *MsgStatusData)) {
+	rums := MsgStatusData{MatrixUser: sp.MatrixUser, StatusIDs: make(map[string]string, len(sp.Networks)+len(sp.NativeIDs)+len(sp.StatusIDs)), ThreadStatusIDs: make(map[string][]string), Action: actionPost, Visibility: sp.Options.visibilityFor("")}
+	/// published before a restart
+	for network, statusid := range sp.StatusIDs {
+		rums.StatusIDs[network] = statusid
+	}
+	for network, threadids := range sp.ThreadStatusIDs {
+		rums.ThreadStatusIDs[network] = threadids
+	}
+	if len(sp.Networks) > 0 {
+		/// one network at a time, so a restart won't publish it again where it is out already
+		for _, p := range publishersByName(sp.Networks) {
+			publishPost(mxcli, markseen_c, []Publisher{p}, sp.EventID, sp.MediaNick(), sp.Text, sp.Options, nil, &rums)
+			networkdone(p.Name(), &rums)
+		}
+		if sp.HasMedia && media_store_ != nil {
+			media_store_.RemoveAll(sp.MediaNick())
+		}
+	}
+	if len(sp.Networks) > 0 || len(sp.StatusIDs) > 0 {
+		rums_store_chan <- RUMSStoreMsg{key: sp.EventID, data: rums}
+	}
+	if len(sp.NativeIDs) == 0 {
+		return
+	}
+	/// networks that published on their own don't tell us the status id, go and look for it
+	for network, scheduledid := range sp.NativeIDs {
+		p := getPublisher(network)
+		scheduler, canschedule := p.(StatusScheduler)
+		if !canschedule {
+			continue
+		}
+		for try := 0; try < scheduled_status_find_tries_; try++ {
+			statusid, err := scheduler.FindScheduledStatus(scheduledid, sp.Due, sp.Options)
+			if err != nil {
+				log.Printf("publishScheduledPost: %s %s", network, err)
+				mxNotify(mxcli, network, fmt.Sprintf("%s was scheduled, but I lost track of it. Redacting won't delete it.", p.StatusNoun()))
+				networkdone(network, &rums)
+				break
+			}
+			if len(statusid) > 0 {
+				rums.StatusIDs[network] = statusid
+				networkdone(network, &rums)
+				if network == mastodon_net && markseen_c != nil {
+					markseen_c <- mastodon.ID(statusid)
+				}
+				mxNotifyStatus(mxcli, network, fmt.Sprintf("scheduled %s #%d is out!", p.StatusNoun(), sp.Number), sp.EventID, rums, network, "")
+				break
+			}
+			time.Sleep(scheduler_check_interval_)
+		}
+	}
+	rums_store_chan <- RUMSStoreMsg{key: sp.EventID, data: rums}
+}
+
+/// reply to the poll event with the results once the mastodon poll ended. Returns false if we should ask again later.
+func reportPollResults(mxcli *gomatrix.Client, mclient *mastodon.Client, wp WatchedPoll) bool {
+	poll, err := mastodonGetStatusPoll(context.Background(), mclient, mastodon.ID(wp.StatusID))
+	if isMastodonNotFound(err) {
+		return true // toot was deleted
+	}
+	if err != nil {
+		log.Println("reportPollResults:", err)
+		return false
+	}
+	if poll == nil {
+		return true
+	}
+	if !poll.Expired {
+		return false
+	}
+	mxNotifyReply(mxcli, "poll", formatPollResults(poll), wp.EventID)
+	return true
+}
+
+func runMatrixPublishBot() {
+	mxcli, _ := gomatrix.NewClient(c["matrix"]["url"], "", "")
+	if _, err := mxLogin(mxcli); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	mclient := initMastodonClient()
-	tclient := initTwitterClient()
-
-	mxcli.SetCredentials(resp.UserID, resp.AccessToken)
-
-	rums_store_chan, rums_retrieve_chan := runRememberUsersMessageToStatus()
 
 	if _, err := mxcli.JoinRoom(c["matrix"]["room_id"], "", nil); err != nil {
 		panic(err)
 	}
 
+	var rums_preload map[string]MsgStatusData = nil
+	if c.GetValueDefault("state", "rebuild_from_room", "false") == "true" {
+		rums_preload = rebuildRUMSFromRoomHistory(mxcli)
+	}
+	rums_store_chan, rums_retrieve_chan := runRememberUsersMessageToStatus(rums_preload)
+
 	var markseen_c chan<- mastodon.ID = nil
 	if c.SectionInConfig("feed2matrix") {
-		markseen_c = taskWriteMastodonBackIntoMatrixRooms(mclient, mxcli)
+		markseen_c = taskWriteMastodonBackIntoMatrixRooms(mclient, mxcli, rums_store_chan)
 	}
 
-	syncer := mxcli.Syncer.(*gomatrix.DefaultSyncer)
+	scheduler := taskRunPostScheduler(func(sp ScheduledPost, networkdone func(string, *MsgStatusData)) {
+		publishScheduledPost(mxcli, markseen_c, rums_store_chan, sp, networkdone)
+	})
+
+	pollwatcher := taskRunPollWatcher(func(wp WatchedPoll) bool {
+		return reportPollResults(mxcli, mclient, wp)
+	})
+
+	syncer := mxSetupSync(mxcli)
+
 	syncer.OnEventType("m.room.message", func(ev *gomatrix.Event) {
 		if mxIgnoreEvent(ev) { //ignore messages from ourselves or from other rooms in case of dual-login
 			return
@@ -125,39 +398,96 @@ func runMatrixPublishBot() {
 			log.Println(ev.Sender)
 			switch mtype {
 			case "m.text":
-				if post, ok := ev.Body(); ok {
+				if editedid, newpost, isedit := mxGetEdit(ev); isedit {
+					/// Edit of an already published post
+					profile := matchPostingProfile(newpost)
+					if profile == nil {
+						return
+					}
+					newpost, editopts, err := profile.ParsePost(newpost)
+					if err != nil {
+						mxNotify(mxcli, "edit", fmt.Sprintf("Not editing this! %s", err.Error()))
+						return
+					}
+					if err = checkCharacterLimit(newpost, editopts, profile.Publishers()); err != nil {
+						mxNotify(mxcli, "limitcheck", fmt.Sprintf("Not editing this! %s", err.Error()))
+						return
+					}
+					go func() {
+						rums_ptr := retrieveRUMS(rums_retrieve_chan, editedid)
+						if rums_ptr == nil || rums_ptr.Action != actionPost {
+							return
+						}
+						if rums_ptr.MatrixUser != ev.Sender {
+							mxNotify(mxcli, "edit", "Won't edit other users status for you!")
+							return
+						}
+						if len(rums_ptr.ThreadStatusIDs) > 0 {
+							mxNotify(mxcli, "edit", "Can't edit a thread. Please redact your message and post it again.")
+							return
+						}
+						/// mastodon can't change visibility of a status and we won't make a private post public by reposting it
+						if len(editopts.Visibility) == 0 {
+							editopts.Visibility = rums_ptr.Visibility
+						} else if editopts.Visibility != rums_ptr.Visibility {
+							mxNotify(mxcli, "edit", "Can't change the visibility of a status. Please redact your message and post it again.")
+							return
+						}
+						lock := getPerUserLock(ev.Sender)
+						lock.Lock()
+						defer lock.Unlock()
+						rums := *rums_ptr
+						rums.StatusIDs = make(map[string]string, len(rums_ptr.StatusIDs))
+						for _, p := range publishers_ {
+							statusid, inmap := rums_ptr.StatusIDs[p.Name()]
+							if !inmap || len(statusid) == 0 {
+								continue
+							}
+							if err := p.Accepts(editopts); err != nil {
+								mxNotify(mxcli, "edit", fmt.Sprintf("Not editing %s: %s", p.StatusNoun(), err.Error()))
+								rums.StatusIDs[p.Name()] = statusid
+								continue
+							}
+							reviewurl, newstatusid, reposted, err := editOrRepost(p, statusid, newpost, editopts)
+							if err != nil {
+								log.Printf("%s EditERROR: %s", p.Name(), err)
+								mxNotify(mxcli, "edit", fmt.Sprintf("ERROR while editing %s! %s", p.StatusNoun(), err.Error()))
+								rums.StatusIDs[p.Name()] = statusid
+								continue
+							}
+							rums.StatusIDs[p.Name()] = newstatusid
+							if reposted {
+								if p.Name() == mastodon_net && markseen_c != nil {
+									markseen_c <- mastodon.ID(newstatusid)
+								}
+								mxNotifyStatus(mxcli, "edit", fmt.Sprintf("%s can't be edited, deleted it and sent a new one! %s", p.StatusNoun(), reviewurl), editedid, rums, p.Name(), reviewurl)
+							} else {
+								mxNotifyStatus(mxcli, "edit", fmt.Sprintf("edited %s! %s", p.StatusNoun(), reviewurl), editedid, rums, p.Name(), reviewurl)
+							}
+						}
+						rums_store_chan <- RUMSStoreMsg{key: editedid, data: rums}
+					}()
+				} else if post, ok := ev.Body(); ok {
+					replyto_eventid, isreply := mxGetInReplyTo(ev)
+					if isreply {
+						post = mxStripReplyFallback(post)
+					}
 					log.Printf("Message: '%s'", post)
 					if strings.HasPrefix(post, reblog_cmd_) {
 						/// CMD Reblogging
 
 						go func() {
 							if err := parseReblogFavouriteArgs(reblog_cmd_, post, mxcli,
-								func(statusid string) error {
-									_, err := mclient.Reblog(context.Background(), mastodon.ID(statusid))
+								func(p Publisher, statusid string) error {
+									err := p.Reblog(statusid)
 									if err == nil {
-										rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: MsgStatusData{MatrixUser: ev.Sender, TootID: mastodon.ID(statusid), Action: actionReblog}}
+										rums := MsgStatusData{MatrixUser: ev.Sender, StatusIDs: map[string]string{p.Name(): statusid}, Action: actionReblog}
+										rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: rums}
+										mxNotifyStatus(mxcli, "reblog", "Ok, I reblogged/retweeted that status for you", ev.ID, rums, p.Name(), "")
 									}
-
 									return err
 								},
-								func(postidstr string) error {
-									postid, err := strconv.ParseInt(postidstr, 10, 64)
-									if err != nil {
-										return err
-									}
-									if postid <= 0 {
-										return fmt.Errorf("Sorry could not parse status id")
-									}
-									_, err = tclient.Retweet(postid, true)
-									if err == nil {
-										rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: MsgStatusData{MatrixUser: ev.Sender, TweetID: postid, Action: actionReblog}}
-									}
-
-									return err
-								},
-							); err == nil {
-								mxNotify(mxcli, "reblog", "Ok, I reblogged/retweeted that status for you")
-							} else {
+							); err != nil {
 								mxNotify(mxcli, "reblog", fmt.Sprintf("error reblogging/retweeting: %s", err.Error()))
 							}
 						}()
@@ -166,41 +496,60 @@ func runMatrixPublishBot() {
 
 						go func() {
 							err := parseReblogFavouriteArgs(favourite_cmd_, post, mxcli,
-								func(statusid string) error {
-									_, err := mclient.Favourite(context.Background(), mastodon.ID(statusid))
+								func(p Publisher, statusid string) error {
+									err := p.Favourite(statusid)
 									if err == nil {
-										rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: MsgStatusData{MatrixUser: ev.Sender, TootID: mastodon.ID(statusid), Action: actionFav}}
-									}
-									return err
-								},
-								func(postidstr string) error {
-									postid, err := strconv.ParseInt(postidstr, 10, 64)
-									if err != nil {
-										return err
-									}
-									if postid <= 0 {
-										return fmt.Errorf("Sorry could not parse status id")
-									}
-									_, err = tclient.Favorite(postid)
-									if err == nil {
-										rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: MsgStatusData{MatrixUser: ev.Sender, TweetID: postid, Action: actionFav}}
+										rums := MsgStatusData{MatrixUser: ev.Sender, StatusIDs: map[string]string{p.Name(): statusid}, Action: actionFav}
+										rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: rums}
+										mxNotifyStatus(mxcli, "favourite", "Ok, I favourited that status for you", ev.ID, rums, p.Name(), "")
 									}
 									return err
 								},
 							)
-							if err == nil {
-								mxNotify(mxcli, "favourite", "Ok, I favourited that status for you")
+							if err != nil {
+								mxNotify(mxcli, "favourite", fmt.Sprintf("error favouriting: %s", err.Error()))
+							}
+						}()
+					} else if strings.HasPrefix(post, schedule_cmd_) {
+						/// CMD Scheduling
 
+						go func() {
+							if err := handleScheduleCommand(mxcli, scheduler, ev, post); err != nil {
+								mxNotify(mxcli, "schedule", fmt.Sprintf("error scheduling: %s", err.Error()))
+							}
+						}()
+					} else if strings.HasPrefix(post, alt_cmd_) {
+						/// CMD Alt Text
+
+						go func() {
+							/// reply to the image to describe it, or describe the last one queued
+							eventid := ""
+							if isreply {
+								eventid = replyto_eventid
+							}
+							alttext := strings.TrimSpace(post[len(alt_cmd_):])
+							lock := getPerUserLock(ev.Sender)
+							lock.Lock()
+							defer lock.Unlock()
+							if err := setQueuedMediaAltText(ev.Sender, eventid, alttext); err != nil {
+								mxNotify(mxcli, "alt", err.Error())
+							} else if len(alttext) == 0 {
+								mxNotify(mxcli, "alt", "Ok, removed the description")
 							} else {
-								mxNotify(mxcli, "favourite", fmt.Sprintf("error favouriting: %s", err.Error()))
+								mxNotify(mxcli, "alt", "Ok, will use that as description")
 							}
 						}()
-					} else if strings.HasPrefix(post, guard_prefix_) {
+					} else if profile := matchPostingProfile(post); profile != nil {
 						/// CMD Posting
 
-						post = strings.TrimSpace(post[len(guard_prefix_):])
+						publishers := profile.Publishers()
+						post, postopts, err := profile.ParsePost(post)
+						if err != nil {
+							mxNotify(mxcli, "postoptions", fmt.Sprintf("Not tweeting/tooting this! %s", err.Error()))
+							return
+						}
 
-						if err = checkCharacterLimit(post); err != nil {
+						if err = checkPostLength(post, postopts, publishers); err != nil {
 							log.Println(err)
 							mxNotify(mxcli, "limitcheck", fmt.Sprintf("Not tweeting/tooting this! %s", err.Error()))
 							return
@@ -210,80 +559,85 @@ func runMatrixPublishBot() {
 							lock := getPerUserLock(ev.Sender)
 							lock.Lock()
 							defer lock.Unlock()
-							var reviewurl string
-							var twitterid int64
-							var mastodonid mastodon.ID
-
-							if c["server"]["mastodon"] == "true" {
-								reviewurl, mastodonid, err = sendToot(mclient, post, ev.Sender)
-								if markseen_c != nil {
-									markseen_c <- mastodonid
-								}
-								if err != nil {
-									log.Println("MastodonTootERROR:", err)
-									mxNotify(mxcli, "mastodon", "ERROR while tooting!")
-								} else {
-									mxNotify(mxcli, "mastodon", fmt.Sprintf("sent toot! %s", reviewurl))
-								}
+							/// a matrix reply to one of our published messages becomes a reply on each network
+							var replyto_ptr *MsgStatusData = nil
+							if isreply {
+								replyto_ptr = retrieveRUMS(rums_retrieve_chan, replyto_eventid)
 							}
-
-							if c["server"]["twitter"] == "true" {
-								reviewurl, twitterid, err = sendTweet(tclient, post, ev.Sender)
-								if err != nil {
-									log.Println("TwitterTweetERROR:", err)
-									mxNotify(mxcli, "twitter", "ERROR while tweeting!")
-								} else {
-									mxNotify(mxcli, "twitter", fmt.Sprintf("sent tweet! %s", reviewurl))
+							/// replies to followers-only or direct status stay that way, also on networks the status is not on
+							if replyto_ptr != nil && len(postopts.Visibility) == 0 && isRestrictedVisibility(replyto_ptr.Visibility) {
+								postopts.Visibility = postopts.visibilityFor(replyto_ptr.Visibility)
+							}
+							if replyto_ptr != nil {
+								if err := checkReplyLength(post, postopts, publishers, replyto_ptr); err != nil {
+									mxNotify(mxcli, "limitcheck", fmt.Sprintf("Not tweeting/tooting this! %s", err.Error()))
+									return
 								}
 							}
 
+							rums := MsgStatusData{MatrixUser: ev.Sender, StatusIDs: make(map[string]string, len(publishers)), ThreadStatusIDs: make(map[string][]string), Action: actionPost, Visibility: postopts.visibilityFor("")}
+
+							failed := publishPost(mxcli, markseen_c, publishers, ev.ID, ev.Sender, post, postopts, replyto_ptr, &rums)
+
 							//remember posted status IDs
-							rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: MsgStatusData{ev.Sender, mastodonid, twitterid, actionPost}}
+							rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: rums}
 
-							//remove saved image file if present. We only attach an image once.
+							//remove saved image file if present. We only attach an image once, unless sending it failed.
 							if c.GetValueDefault("images", "enabled", "false") == "true" {
-								rmAllUserFiles(ev.Sender)
+								if !failed {
+									media_store_.RemoveAll(ev.Sender)
+								} else if queued, _ := getQueuedMedia(ev.Sender); len(queued) > 0 {
+									mxNotify(mxcli, "media", "Kept your files for the next post. Redact them if you don't want them there.")
+								}
 							}
 
 						}()
 					}
 				}
-			case "m.image":
+			case "m.image", "m.video", "m.audio":
 				if c.GetValueDefault("images", "enabled", "false") != "true" {
-					mxNotify(mxcli, "error", "image support is disabled. Set [images]enabled=true")
-					fmt.Println("ignoring image since support not enabled in config file")
+					mxNotify(mxcli, "error", "image/video/audio support is disabled. Set [images]enabled=true")
+					fmt.Println("ignoring media since support not enabled in config file")
 					return
 				}
-				if infomapi, inmap := ev.Content["info"]; inmap {
-					if infomap, ok := infomapi.(map[string]interface{}); ok {
-						if imgsizei, insubmap := infomap["size"]; insubmap {
-							if imgsize, ok2 := imgsizei.(int64); ok2 {
-								if err = checkImageBytesizeLimit(imgsize); err != nil {
-									mxNotify(mxcli, "imagesaver", err.Error())
-									return
-								}
-							}
-						}
+				mimetype := mx_default_mimetypes_[mtype]
+				if infomap, ok := ev.Content["info"].(map[string]interface{}); ok {
+					if infomimetype, ok := infomap["mimetype"].(string); ok && len(infomimetype) > 0 {
+						mimetype = infomimetype
 					}
-				}
-				if urli, inmap := ev.Content["url"]; inmap {
-					if url, ok := urli.(string); ok {
-						go func() {
-							lock := getPerUserLock(ev.Sender)
-							lock.Lock()
-							defer lock.Unlock()
-							if err := saveMatrixFile(mxcli, ev.Sender, ev.ID, url); err != nil {
-								mxNotify(mxcli, "error", "Could not get your image! "+err.Error())
-								fmt.Println("ERROR downloading image:", err)
-								return
-							}
-							mxNotify(mxcli, "imagesaver", fmt.Sprintf("image saved. Will tweet/toot with %s's next message", ev.Sender))
-						}()
+					var size int64 = 0
+					var duration time.Duration = 0
+					if sizef, ok := infomap["size"].(float64); ok {
+						size = int64(sizef)
+					}
+					if durationms, ok := infomap["duration"].(float64); ok {
+						duration = time.Duration(durationms) * time.Millisecond
+					}
+					if err := checkMediaLimits(mimetype, size, duration); err != nil {
+						mxNotify(mxcli, "imagesaver", err.Error())
+						return
 					}
 				}
-			case "m.video", "m.audio":
-				fmt.Printf("%s messages are currently not supported", mtype)
-				mxNotify(mxcli, "runMatrixPublishBot", "Ahh. Audio/Video files are not supported directly. Please just include it's URL in your Toot/Tweet and Mastodon/Twitter will do the rest.")
+				if url, ok := ev.Content["url"].(string); ok {
+					go func() {
+						lock := getPerUserLock(ev.Sender)
+						lock.Lock()
+						defer lock.Unlock()
+						if err := saveMatrixFile(mxcli, ev.Sender, ev.ID, url, mimetype, mxGetMediaCaption(ev)); err != nil {
+							mxNotify(mxcli, "error", "Could not get your file! "+err.Error())
+							fmt.Println("ERROR downloading media:", err)
+							return
+						}
+						msg := fmt.Sprintf("%s saved. Will tweet/toot with %s's next message", strings.TrimPrefix(mtype, "m."), ev.Sender)
+						if len(mxGetMediaCaption(ev)) == 0 && isImageMediaType(mimetype) {
+							msg += fmt.Sprintf(". Describe it with %s", alt_cmd_)
+						}
+						if leftout := networksNotSupportingMediaType(mimetype); len(leftout) > 0 {
+							msg += fmt.Sprintf(", but not on %s", strings.Join(leftout, ", "))
+						}
+						mxNotify(mxcli, "imagesaver", msg)
+					}()
+				}
 			default:
 				fmt.Printf("%s messages are currently not supported", mtype)
 				//remove saved image file if present. We only attach an image once.
@@ -291,6 +645,53 @@ func runMatrixPublishBot() {
 		}
 	})
 
+	/// Publish matrix polls as mastodon polls
+	pollhandler := func(ev *gomatrix.Event) {
+		if mxIgnoreEvent(ev) { //ignore messages from ourselves or from other rooms in case of dual-login
+			return
+		}
+		mxpoll, ok := mxGetPollStart(ev)
+		if !ok {
+			return
+		}
+		profile := matchPostingProfile(mxpoll.Question)
+		if profile == nil {
+			return
+		}
+		publishers := profile.Publishers()
+		post, postopts, err := profile.ParsePollPost(mxpoll.Question)
+		if err != nil {
+			mxNotify(mxcli, "postoptions", fmt.Sprintf("Not tooting this poll! %s", err.Error()))
+			return
+		}
+		if postopts.Poll == nil {
+			postopts.Poll = &PostPoll{}
+		}
+		postopts.Poll.Options = mxpoll.Answers
+		postopts.Poll.Multiple = mxpoll.MaxSelections > 1
+		postopts.Poll.HideTotals = !mxpoll.Disclosed
+		if postopts.Poll.ExpiresIn == 0 {
+			postopts.Poll.ExpiresIn = poll_duration_
+		}
+		if err = checkPostLength(post, postopts, publishers); err != nil {
+			mxNotify(mxcli, "limitcheck", fmt.Sprintf("Not tooting this poll! %s", err.Error()))
+			return
+		}
+		go func() {
+			lock := getPerUserLock(ev.Sender)
+			lock.Lock()
+			defer lock.Unlock()
+			rums := MsgStatusData{MatrixUser: ev.Sender, StatusIDs: make(map[string]string, len(publishers)), ThreadStatusIDs: make(map[string][]string), Action: actionPost, Visibility: postopts.visibilityFor("")}
+			publishPost(mxcli, markseen_c, publishers, ev.ID, "", post, postopts, nil, &rums)
+			rums_store_chan <- RUMSStoreMsg{key: ev.ID, data: rums}
+			if statusid := rums.StatusIDs[mastodon_net]; len(statusid) > 0 {
+				pollwatcher.Add(WatchedPoll{EventID: ev.ID, StatusID: statusid, ExpiresAt: time.Now().Add(postopts.Poll.ExpiresIn)})
+			}
+		}()
+	}
+	syncer.OnEventType(mx_poll_start_event_, pollhandler)
+	syncer.OnEventType(mx_poll_start_event_unstable_, pollhandler)
+
 	/// Support redactions to "take back an uploaded image"
 	syncer.OnEventType("m.room.redaction", func(ev *gomatrix.Event) {
 		if mxIgnoreEvent(ev) { //ignore messages from ourselves or from other rooms in case of dual-login
@@ -301,7 +702,7 @@ func runMatrixPublishBot() {
 				lock := getPerUserLock(ev.Sender)
 				lock.Lock()
 				defer lock.Unlock()
-				err := rmFile(ev.Sender, ev.Redacts)
+				err := media_store_.Remove(ev.Sender, queuedMediaID(ev.Redacts))
 				if err == nil {
 					mxNotify(mxcli, "redaction", fmt.Sprintf("%s's image has been redacted. Next toot/weet will not contain that image.", ev.Sender))
 				}
@@ -312,66 +713,66 @@ func runMatrixPublishBot() {
 			}()
 		}
 		go func() {
-			future_chan := make(chan *MsgStatusData, 1)
-			rums_retrieve_chan <- RUMSRetrieveMsg{key: ev.Redacts, future: future_chan}
-			rums_ptr := <-future_chan
-			if rums_ptr == nil {
+			sp, scheduled := scheduler.Get(ev.Redacts)
+			if !scheduled {
+				return
+			}
+			if sp.MatrixUser != ev.Sender && c.GetValueDefault("matrix", "admins_can_redact_user_status", "false") != "true" {
+				mxNotify(mxcli, "redaction", "Won't cancel other users scheduled posts for you! Set admins_can_redact_user_status=true if you disagree.")
+				return
+			}
+			if err := scheduler.Cancel(ev.Redacts); err != nil {
+				log.Println("Cancel scheduled post ERROR:", err)
+				mxNotify(mxcli, "redaction", fmt.Sprintf("Could not cancel scheduled post #%d everywhere", sp.Number))
+				return
+			}
+			mxNotify(mxcli, "redaction", fmt.Sprintf("Ok, cancelled scheduled post #%d", sp.Number))
+		}()
+		go func() {
+			rums_ptr := retrieveRUMS(rums_retrieve_chan, ev.Redacts)
+			if rums_ptr == nil || rums_ptr.Action == actionMirror {
 				return
 			}
 			if c.GetValueDefault("matrix", "admins_can_redact_user_status", "false") == "true" || rums_ptr.MatrixUser == ev.Sender {
-				switch rums_ptr.Action {
-				case actionPost:
-					if rums_ptr.TweetID > 0 {
-						if _, err := tclient.DeleteTweet(rums_ptr.TweetID, true); err == nil {
-							mxNotify(mxcli, "redaction", "Ok, I deleted that tweet for you")
-						} else {
-							log.Println("RedactTweetERROR:", err)
-							mxNotify(mxcli, "redaction", "Could not redact your tweet")
-						}
+				for _, p := range publishers_ {
+					statusid, inmap := rums_ptr.StatusIDs[p.Name()]
+					if !inmap || len(statusid) == 0 {
+						continue
 					}
-					if len(rums_ptr.TootID) > 0 {
-						if err := mclient.DeleteStatus(context.Background(), rums_ptr.TootID); err == nil {
-							mxNotify(mxcli, "redaction", "Ok, I deleted that toot for you")
-						} else {
-							log.Println("RedactTweetERROR", err)
-							mxNotify(mxcli, "redaction", "Could not redact your toot")
+					switch rums_ptr.Action {
+					case actionPost:
+						var err error
+						statusids := rums_ptr.AllStatusIDsReversed(p.Name())
+						for _, statusid := range statusids {
+							if delerr := p.Delete(statusid); delerr != nil {
+								err = delerr
+							}
 						}
-					}
-				case actionReblog:
-					if rums_ptr.TweetID > 0 {
-						if _, err := tclient.UnRetweet(rums_ptr.TweetID, true); err == nil {
-							mxNotify(mxcli, "redaction", "Ok, I un-retweetet that tweet for you")
+						if err == nil {
+							if len(statusids) > 1 {
+								mxNotify(mxcli, "redaction", fmt.Sprintf("Ok, I deleted that thread of %d %ss for you", len(statusids), p.StatusNoun()))
+							} else {
+								mxNotify(mxcli, "redaction", fmt.Sprintf("Ok, I deleted that %s for you", p.StatusNoun()))
+							}
 						} else {
-							log.Println("RedactTweetERROR:", err)
-							mxNotify(mxcli, "redaction", "Could not redact your retweet")
+							log.Printf("Redact %s ERROR: %s", p.Name(), err)
+							mxNotify(mxcli, "redaction", fmt.Sprintf("Could not redact your %s", p.StatusNoun()))
 						}
-					}
-					if len(rums_ptr.TootID) > 0 {
-						if _, err := mclient.Unreblog(context.Background(), rums_ptr.TootID); err == nil {
-							mxNotify(mxcli, "redaction", "Ok, I un-reblogged that toot for you")
+					case actionReblog:
+						if err := p.Unreblog(statusid); err == nil {
+							mxNotify(mxcli, "redaction", fmt.Sprintf("Ok, I un-reblogged that %s for you", p.StatusNoun()))
 						} else {
-							log.Println("RedactTweetERROR", err)
+							log.Printf("Redact %s ERROR: %s", p.Name(), err)
 							mxNotify(mxcli, "redaction", "Could not redact your reblog")
 						}
-					}
-				case actionFav:
-					if rums_ptr.TweetID > 0 {
-						if _, err := tclient.Unfavorite(rums_ptr.TweetID); err == nil {
-							mxNotify(mxcli, "redaction", "Ok, I removed your favor from that tweet")
-						} else {
-							log.Println("RedactTweetERROR:", err)
-							mxNotify(mxcli, "redaction", "Could not redact your favor")
-						}
-					}
-					if len(rums_ptr.TootID) > 0 {
-						if _, err := mclient.Unfavourite(context.Background(), rums_ptr.TootID); err == nil {
-							mxNotify(mxcli, "redaction", "Ok, I removed your favour from that toot")
+					case actionFav:
+						if err := p.Unfavourite(statusid); err == nil {
+							mxNotify(mxcli, "redaction", fmt.Sprintf("Ok, I removed your favour from that %s", p.StatusNoun()))
 						} else {
-							log.Println("RedactTweetERROR", err)
+							log.Printf("Redact %s ERROR: %s", p.Name(), err)
 							mxNotify(mxcli, "redaction", "Could not redact your favour")
 						}
 					}
-
 				}
 			} else {
 				mxNotify(mxcli, "redaction", "Won't redact other users status for you! Set admins_can_redact_user_status=true if you disagree.")
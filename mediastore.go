@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/// Files users queue for their next post stay in a MediaStore until we publish them or the user redacts them.
+/// [images]store=dir keeps them in a temporary directory below [images]temp_dir,
+/// [images]store=memory keeps them in memory, up to [images]memory_limit bytes for all users together,
+/// so we never need to write to the filesystem for them.
+
+type QueuedMedia struct {
+	ID       string // queuedMediaID of the matrix event the file came with
+	MimeType string
+	Size     int64
+	AltText  string
+}
+
+type MediaStore interface {
+	Add(nick string, media QueuedMedia, contents io.Reader) (QueuedMedia, error) // returns media with its Size
+	List(nick string) ([]QueuedMedia, error)                                     // in the order they were queued
+	Open(nick, id string) (io.ReadCloser, error)
+	SetAltText(nick, id, alttext string) error // empty alttext removes the description
+	Remove(nick, id string) error              // returns an error satisfying os.IsNotExist if there is no such file
+	RemoveAll(nick string) error
+}
+
+/// queued files are known by the hex(sha256()) of their matrix event id,
+/// so a malicious user can't choose file names (and hash collision or guessing are not so big a threat here.)
+func queuedMediaID(eventid string) string {
+	shasum := sha256.Sum256([]byte(eventid))
+	return hex.EncodeToString(shasum[:])
+}
+
+/// a file name to upload media with. Some networks look at its extension.
+func (media QueuedMedia) FileName() string {
+	if extensions, _ := mime.ExtensionsByType(media.MimeType); len(extensions) > 0 {
+		return media.ID + extensions[0]
+	}
+	return media.ID
+}
+
+/// copy everything fromnick queued in from to tonick in to and remove it from from. On error, from is left as it was.
+func moveQueuedMedia(from MediaStore, fromnick string, to MediaStore, tonick string) error {
+	if err := copyQueuedMedia(from, fromnick, to, tonick); err != nil {
+		return err
+	}
+	return from.RemoveAll(fromnick)
+}
+
+/// copy everything fromnick queued in from to tonick in to. On error, to has nothing for tonick.
+func copyQueuedMedia(from MediaStore, fromnick string, to MediaStore, tonick string) error {
+	queued, err := from.List(fromnick)
+	if err != nil {
+		return err
+	}
+	for _, media := range queued {
+		contents, err := from.Open(fromnick, media.ID)
+		if err != nil {
+			return err
+		}
+		_, err = to.Add(tonick, media, contents)
+		contents.Close()
+		if err != nil {
+			to.RemoveAll(tonick)
+			return err
+		}
+	}
+	return nil
+}
+
+///////////////
+/// store=dir
+
+/// one directory per user named hex(sha256(nick)), one file per queued media named <id>.<type>_<subtype>,
+/// e.g. <id>.video_mp4 and its description in <id>.<type>_<subtype>.alt
+type dirMediaStore struct {
+	basedir string
+}
+
+const alt_text_suffix_ string = ".alt"
+const download_tmp_suffix_ string = ".tmp"
+
+func newDirMediaStore(basedir string) *dirMediaStore {
+	return &dirMediaStore{basedir: basedir}
+}
+
+func (ds *dirMediaStore) userDir(nick string) string {
+	shasum := sha256.Sum256([]byte(nick))
+	return path.Join(ds.basedir, hex.EncodeToString(shasum[:]))
+}
+
+/// the path of media id of nick, whatever its type
+func (ds *dirMediaStore) findFile(nick, id string) (string, error) {
+	matches, _ := filepath.Glob(path.Join(ds.userDir(nick), id) + "*")
+	for _, match := range matches {
+		if !strings.HasSuffix(match, download_tmp_suffix_) && !strings.HasSuffix(match, alt_text_suffix_) {
+			return match, nil
+		}
+	}
+	return "", &os.PathError{Op: "open", Path: path.Join(ds.userDir(nick), id), Err: os.ErrNotExist}
+}
+
+/// write to a temporary file first, so List never sees half of it
+func (ds *dirMediaStore) Add(nick string, media QueuedMedia, contents io.Reader) (QueuedMedia, error) {
+	userdir := ds.userDir(nick)
+	if err := os.MkdirAll(userdir, 0700); err != nil {
+		return media, err
+	}
+	mediapath := path.Join(userdir, media.ID) + mediaFileSuffix(media.MimeType)
+	fh, err := os.OpenFile(mediapath+download_tmp_suffix_, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0400)
+	if err != nil {
+		return media, err
+	}
+	media.Size, err = io.Copy(fh, contents)
+	if closeerr := fh.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		os.Remove(mediapath + download_tmp_suffix_)
+		return media, err
+	}
+	if len(media.AltText) > 0 {
+		if err = ioutil.WriteFile(mediapath+alt_text_suffix_, []byte(media.AltText), 0600); err != nil {
+			os.Remove(mediapath + download_tmp_suffix_)
+			return media, err
+		}
+	}
+	return media, os.Rename(mediapath+download_tmp_suffix_, mediapath)
+}
+
+func (ds *dirMediaStore) List(nick string) ([]QueuedMedia, error) {
+	userdir := ds.userDir(nick)
+	fileinfos, err := ioutil.ReadDir(userdir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(fileinfos, func(i, j int) bool { return fileinfos[i].ModTime().Before(fileinfos[j].ModTime()) })
+	queued := make([]QueuedMedia, 0, len(fileinfos))
+	for _, fileinfo := range fileinfos {
+		if strings.HasSuffix(fileinfo.Name(), download_tmp_suffix_) || strings.HasSuffix(fileinfo.Name(), alt_text_suffix_) {
+			continue
+		}
+		mediapath := path.Join(userdir, fileinfo.Name())
+		alttext, _ := ioutil.ReadFile(mediapath + alt_text_suffix_)
+		queued = append(queued, QueuedMedia{
+			ID:       strings.SplitN(fileinfo.Name(), ".", 2)[0],
+			MimeType: mediaTypeOfFile(mediapath),
+			Size:     fileinfo.Size(),
+			AltText:  string(alttext),
+		})
+	}
+	return queued, nil
+}
+
+func (ds *dirMediaStore) Open(nick, id string) (io.ReadCloser, error) {
+	mediapath, err := ds.findFile(nick, id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(mediapath)
+}
+
+func (ds *dirMediaStore) SetAltText(nick, id, alttext string) error {
+	mediapath, err := ds.findFile(nick, id)
+	if err != nil {
+		return err
+	}
+	if len(alttext) == 0 {
+		if err = os.Remove(mediapath + alt_text_suffix_); os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(mediapath+alt_text_suffix_, []byte(alttext), 0600)
+}
+
+/// removes the file with its description
+func (ds *dirMediaStore) Remove(nick, id string) error {
+	matches, _ := filepath.Glob(path.Join(ds.userDir(nick), id) + "*")
+	if len(matches) == 0 {
+		return &os.PathError{Op: "remove", Path: path.Join(ds.userDir(nick), id), Err: os.ErrNotExist}
+	}
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *dirMediaStore) RemoveAll(nick string) error {
+	return os.RemoveAll(ds.userDir(nick))
+}
+
+/// queued files carry their mime type in their name, e.g. <id>.video_mp4
+func mediaFileSuffix(mimetype string) string {
+	mimetype = strings.ToLower(mimetype)
+	for _, r := range mimetype {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && !strings.ContainsRune("/.+-", r) {
+			return ""
+		}
+	}
+	if strings.Count(mimetype, "/") != 1 {
+		return ""
+	}
+	return "." + strings.Replace(mimetype, "/", "_", 1)
+}
+
+/// the mime type of a queued file, from its name or else from its contents
+func mediaTypeOfFile(mediapath string) string {
+	if ext := path.Ext(mediapath); len(ext) > 1 && strings.Contains(ext, "_") {
+		return strings.Replace(ext[1:], "_", "/", 1)
+	}
+	fh, err := os.Open(mediapath)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer fh.Close()
+	head := make([]byte, 512)
+	numread, _ := io.ReadFull(fh, head)
+	return http.DetectContentType(head[:numread])
+}
+
+//////////////////
+/// store=memory
+
+type memoryMedia struct {
+	QueuedMedia
+	contents []byte
+}
+
+type memoryMediaStore struct {
+	lock  sync.Mutex
+	limit int64
+	used  int64
+	media map[string][]*memoryMedia // nick -> queued media in order
+}
+
+func newMemoryMediaStore(limit int64) *memoryMediaStore {
+	return &memoryMediaStore{limit: limit, media: make(map[string][]*memoryMedia, 10)}
+}
+
+func (ms *memoryMediaStore) free() int64 {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	return ms.limit - ms.used
+}
+
+/// we don't hold the lock while reading contents, so check there is still room afterwards
+func (ms *memoryMediaStore) Add(nick string, media QueuedMedia, contents io.Reader) (QueuedMedia, error) {
+	free := ms.free()
+	buf := &bytes.Buffer{}
+	read, err := io.Copy(buf, io.LimitReader(contents, free+1))
+	if err != nil {
+		return media, err
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if read > free || ms.used+read > ms.limit {
+		return media, fmt.Errorf("Not enough room for more files right now. Post or redact what is queued first.")
+	}
+	media.Size = read
+	ms.used += read
+	ms.media[nick] = append(ms.media[nick], &memoryMedia{QueuedMedia: media, contents: buf.Bytes()})
+	return media, nil
+}
+
+func (ms *memoryMediaStore) List(nick string) ([]QueuedMedia, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	queued := make([]QueuedMedia, len(ms.media[nick]))
+	for idx, mm := range ms.media[nick] {
+		queued[idx] = mm.QueuedMedia
+	}
+	return queued, nil
+}
+
+/// call with ms.lock held
+func (ms *memoryMediaStore) find(nick, id string) (int, error) {
+	for idx, mm := range ms.media[nick] {
+		if mm.ID == id {
+			return idx, nil
+		}
+	}
+	return -1, os.ErrNotExist
+}
+
+/// contents are never changed, only replaced, so readers may keep reading after the lock is released
+func (ms *memoryMediaStore) Open(nick, id string) (io.ReadCloser, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	idx, err := ms.find(nick, id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(ms.media[nick][idx].contents)), nil
+}
+
+func (ms *memoryMediaStore) SetAltText(nick, id, alttext string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	idx, err := ms.find(nick, id)
+	if err != nil {
+		return err
+	}
+	ms.media[nick][idx].AltText = alttext
+	return nil
+}
+
+func (ms *memoryMediaStore) Remove(nick, id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	idx, err := ms.find(nick, id)
+	if err != nil {
+		return err
+	}
+	ms.used -= ms.media[nick][idx].Size
+	ms.media[nick] = append(ms.media[nick][:idx], ms.media[nick][idx+1:]...)
+	if len(ms.media[nick]) == 0 {
+		delete(ms.media, nick)
+	}
+	return nil
+}
+
+func (ms *memoryMediaStore) RemoveAll(nick string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, mm := range ms.media[nick] {
+		ms.used -= mm.Size
+	}
+	delete(ms.media, nick)
+	return nil
+}
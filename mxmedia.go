@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+/// Homeservers are moving media behind authentication (MSC3916, spec v1.11): downloads then go to
+/// /_matrix/client/v1/media/download with our access token. Servers that don't advertise it get the old unauthenticated path.
+
+const mx_media_info_refresh_ time.Duration = time.Hour
+
+type MxMediaServerInfo struct {
+	Authenticated  bool  // server wants media downloaded via /_matrix/client/v1/media
+	MaxUploadBytes int64 // m.upload.size, zero if the server does not tell
+	fetched        time.Time
+}
+
+type mxVersions struct {
+	Versions         []string        `json:"versions"`
+	UnstableFeatures map[string]bool `json:"unstable_features"`
+}
+
+type mxMediaConfig struct {
+	UploadSize int64 `json:"m.upload.size"`
+}
+
+var mx_media_info_lock_ sync.Mutex
+var mx_media_info_ MxMediaServerInfo
+
+/// server name (with port or IPv6 address) and media id. Anything else could send our token to other endpoints.
+var mxc_url_re_ = regexp.MustCompile(`^mxc://([A-Za-z0-9.\-:\[\]]+)/([A-Za-z0-9_\-]+)$`)
+
+func mxSupportsAuthenticatedMedia(versions mxVersions) bool {
+	if versions.UnstableFeatures["org.matrix.msc3916.stable"] {
+		return true
+	}
+	for _, version := range versions.Versions {
+		var major, minor int
+		if _, err := fmt.Sscanf(version, "v%d.%d", &major, &minor); err == nil && (major > 1 || (major == 1 && minor >= 11)) {
+			return true
+		}
+	}
+	return false
+}
+
+/// what the homeserver tells us about media, asked at most once per mx_media_info_refresh_.
+/// If we can't reach it, we ask again next time.
+func mxGetMediaServerInfo(cli *gomatrix.Client) MxMediaServerInfo {
+	mx_media_info_lock_.Lock()
+	defer mx_media_info_lock_.Unlock()
+	if !mx_media_info_.fetched.IsZero() && time.Since(mx_media_info_.fetched) < mx_media_info_refresh_ {
+		return mx_media_info_
+	}
+	var versions mxVersions
+	if err := cli.MakeRequest(http.MethodGet, cli.BuildBaseURL("_matrix", "client", "versions"), nil, &versions); err != nil {
+		log.Println("mxGetMediaServerInfo:", err)
+		return mx_media_info_
+	}
+	info := MxMediaServerInfo{Authenticated: mxSupportsAuthenticatedMedia(versions), fetched: time.Now()}
+	configurl := cli.BuildBaseURL("_matrix", "media", "r0", "config")
+	if info.Authenticated {
+		configurl = cli.BuildBaseURL("_matrix", "client", "v1", "media", "config")
+	}
+	var config mxMediaConfig
+	if err := cli.MakeRequest(http.MethodGet, configurl, nil, &config); err != nil {
+		log.Println("mxGetMediaServerInfo:", err)
+	} else {
+		info.MaxUploadBytes = config.UploadSize
+	}
+	mx_media_info_ = info
+	return info
+}
+
+/// GET the content of mxcurl, authenticated if the server wants it. The caller closes the body.
+func mxDownloadMedia(cli *gomatrix.Client, mxcurl string) (*http.Response, error) {
+	parts := mxc_url_re_.FindStringSubmatch(mxcurl)
+	if parts == nil {
+		return nil, fmt.Errorf("media url not a matrix content mxc://..  uri")
+	}
+	servername, mediaid := parts[1], parts[2]
+	if mxGetMediaServerInfo(cli).Authenticated {
+		req, err := http.NewRequest(http.MethodGet, cli.BuildBaseURL("_matrix", "client", "v1", "media", "download", servername, mediaid), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+		resp, err := cli.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+		/// a proxy in front of the server may not know the new endpoint yet
+		if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusMethodNotAllowed {
+			return nil, fmt.Errorf("downloading media: %s", resp.Status)
+		}
+	}
+	resp, err := cli.Client.Get(cli.BuildBaseURL("_matrix", "media", "r0", "download", servername, mediaid))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading media: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+/// the most bytes we may upload to the homeserver, at most limit
+func mxUploadBytesLimit(cli *gomatrix.Client, limit int64) int64 {
+	if maxupload := mxGetMediaServerInfo(cli).MaxUploadBytes; maxupload > 0 && maxupload < limit {
+		return maxupload
+	}
+	return limit
+}
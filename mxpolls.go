@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+/// Polls started in the controlling room (MSC3381, stable and unstable) are published as Mastodon polls,
+/// if their question starts with a profile prefix. Options like "expires: 3d |" go between prefix and question.
+/// Once the poll ended, we reply to the poll event with the results.
+
+const (
+	mx_poll_start_event_             string = "m.poll.start"
+	mx_poll_start_event_unstable_    string = "org.matrix.msc3381.poll.start"
+	mx_poll_kind_disclosed_          string = "m.disclosed"
+	mx_poll_kind_disclosed_unstable_ string = "org.matrix.msc3381.poll.disclosed"
+)
+
+const polls_state_filename_ string = "polls.json"
+const poll_watcher_check_interval_ time.Duration = time.Minute
+const poll_watcher_give_up_after_ time.Duration = 24 * time.Hour
+
+type MxPollStart struct {
+	Question      string
+	Answers       []string
+	MaxSelections int
+	Disclosed     bool // results are visible while the poll runs
+}
+
+/// the plain text of an extensible event part, stable ("m.text": [{"body": ..}]) or unstable ("org.matrix.msc1767.text": ..)
+func mxExtensibleText(part interface{}) string {
+	partmap, ok := part.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if text, ok := partmap["org.matrix.msc1767.text"].(string); ok {
+		return text
+	}
+	if representations, ok := partmap["m.text"].([]interface{}); ok {
+		for _, representation_i := range representations {
+			representation, ok := representation_i.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if mimetype, hasmimetype := representation["mimetype"].(string); hasmimetype && mimetype != "text/plain" {
+				continue
+			}
+			if body, ok := representation["body"].(string); ok {
+				return body
+			}
+		}
+	}
+	if body, ok := partmap["body"].(string); ok {
+		return body
+	}
+	return ""
+}
+
+func mxGetPollStart(ev *gomatrix.Event) (poll MxPollStart, ok bool) {
+	pollcontent, isstable := ev.Content["m.poll"].(map[string]interface{})
+	if !isstable {
+		if pollcontent, ok = ev.Content[mx_poll_start_event_unstable_].(map[string]interface{}); !ok {
+			return
+		}
+	}
+	poll.Question = strings.TrimSpace(mxExtensibleText(pollcontent["question"]))
+	if kind, ok := pollcontent["kind"].(string); ok {
+		poll.Disclosed = kind == mx_poll_kind_disclosed_ || kind == mx_poll_kind_disclosed_unstable_
+	}
+	poll.MaxSelections = 1
+	if maxselections, ok := pollcontent["max_selections"].(float64); ok && maxselections >= 1 {
+		poll.MaxSelections = int(maxselections)
+	}
+	answers, _ := pollcontent["answers"].([]interface{})
+	for _, answer := range answers {
+		if text := strings.TrimSpace(mxExtensibleText(answer)); len(text) > 0 {
+			poll.Answers = append(poll.Answers, text)
+		}
+	}
+	ok = len(poll.Question) > 0 && len(poll.Answers) > 0
+	return
+}
+
+type WatchedPoll struct {
+	EventID   string // matrix poll event we reply to with the results
+	StatusID  string // mastodon status with the poll
+	ExpiresAt time.Time
+}
+
+type PollWatcher struct {
+	lock  sync.Mutex
+	polls map[string]WatchedPoll
+}
+
+/// calls report for each poll once it should have ended, until report says it is done with it
+func taskRunPollWatcher(report func(WatchedPoll) bool) *PollWatcher {
+	pw := &PollWatcher{polls: make(map[string]WatchedPoll, 4)}
+	loadStateFile(polls_state_filename_, &pw.polls)
+	go func() {
+		for range time.Tick(poll_watcher_check_interval_) {
+			for _, wp := range pw.due(time.Now()) {
+				if report(wp) || time.Since(wp.ExpiresAt) > poll_watcher_give_up_after_ {
+					pw.remove(wp.EventID)
+				}
+			}
+		}
+	}()
+	return pw
+}
+
+func (pw *PollWatcher) Add(wp WatchedPoll) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	pw.polls[wp.EventID] = wp
+	saveStateFile(polls_state_filename_, pw.polls)
+}
+
+func (pw *PollWatcher) remove(eventid string) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	delete(pw.polls, eventid)
+	saveStateFile(polls_state_filename_, pw.polls)
+}
+
+func (pw *PollWatcher) due(now time.Time) []WatchedPoll {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	var due []WatchedPoll
+	for _, wp := range pw.polls {
+		if !wp.ExpiresAt.After(now) {
+			due = append(due, wp)
+		}
+	}
+	return due
+}
+
+func formatPollResults(poll *mastodonPoll) string {
+	total := poll.VotesCount
+	if poll.Multiple && poll.VotersCount != nil {
+		total = *poll.VotersCount // like mastodon, show how many voters chose an option
+	}
+	lines := []string{fmt.Sprintf("Poll ended with %d votes:", poll.VotesCount)}
+	for _, option := range poll.Options {
+		votes := 0
+		if option.VotesCount != nil {
+			votes = *option.VotesCount
+		}
+		percent := 0
+		if total > 0 {
+			percent = votes * 100 / total
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d (%d%%)", option.Title, votes, percent))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+type MxInReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+type MxRelatesTo struct {
+	RelType   string       `json:"rel_type,omitempty"`
+	EventID   string       `json:"event_id,omitempty"`
+	InReplyTo *MxInReplyTo `json:"m.in_reply_to,omitempty"`
+}
+
+type MxReplyMessage struct {
+	MsgType   string      `json:"msgtype"`
+	Body      string      `json:"body"`
+	RelatesTo MxRelatesTo `json:"m.relates_to"`
+}
+
+/// unmarshal a part of an events content into a struct by going through json once more
+func mxContentToStruct(contentpart interface{}, target interface{}) error {
+	contents, err := json.Marshal(contentpart)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contents, target)
+}
+
+func mxGetRelatesTo(ev *gomatrix.Event) (relation MxRelatesTo, ok bool) {
+	relates_to_i, inmap := ev.Content["m.relates_to"]
+	if !inmap {
+		return
+	}
+	ok = mxContentToStruct(relates_to_i, &relation) == nil
+	return
+}
+
+/// if ev is an edit (m.replace) returns the edited event id and the new body
+func mxGetEdit(ev *gomatrix.Event) (eventid string, newbody string, isedit bool) {
+	relation, ok := mxGetRelatesTo(ev)
+	if !ok || relation.RelType != "m.replace" || len(relation.EventID) == 0 {
+		return
+	}
+	new_content, ok := ev.Content["m.new_content"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	newbody, isedit = new_content["body"].(string)
+	eventid = relation.EventID
+	return
+}
+
+/// returns the event id ev replies to, if any
+func mxGetInReplyTo(ev *gomatrix.Event) (eventid string, isreply bool) {
+	relation, ok := mxGetRelatesTo(ev)
+	if !ok || relation.InReplyTo == nil || len(relation.InReplyTo.EventID) == 0 {
+		return
+	}
+	return relation.InReplyTo.EventID, true
+}
+
+/// replies may start with a quote of the message replied to ("> <@user:example.org> ...") followed by an empty line.
+/// We only want what the user actually wrote.
+func mxStripReplyFallback(body string) string {
+	if !strings.HasPrefix(body, "> ") {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	for idx, line := range lines {
+		if !strings.HasPrefix(line, ">") {
+			return strings.TrimLeft(strings.Join(lines[idx:], "\n"), "\n")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+/// Logging in with a password gives us a new matrix device every time, so instead we reuse a session:
+/// [matrix]access_token (with [matrix]device_id) if configured, else the session we stored in [state]dir last time.
+/// Only if neither works do we log in with [matrix]password, keeping our old device id, and store the new session.
+/// mycete -logout ends the stored session, mycete -cleanup-devices lists the devices earlier versions probably left behind
+/// and with -confirm deletes them.
+
+const mx_session_filename_ string = "matrixsession.json"
+const mx_device_display_name_ string = "mycete"
+
+/// the matrix user we are logged in as, so we can ignore our own messages
+var mx_user_id_ string
+
+type MxSession struct {
+	HomeserverURL string `json:"homeserver_url"`
+	UserID        string `json:"user_id"`
+	AccessToken   string `json:"access_token"`
+	DeviceID      string `json:"device_id"`
+}
+
+type mxRespWhoami struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+type mxDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name"`
+	LastSeenIP  string `json:"last_seen_ip"`
+	LastSeenTS  int64  `json:"last_seen_ts"`
+}
+
+func (device mxDevice) String() string {
+	lastseen := "never"
+	if device.LastSeenTS > 0 {
+		lastseen = time.Unix(0, device.LastSeenTS*int64(time.Millisecond)).Format("2006-01-02 15:04") + " from " + device.LastSeenIP
+	}
+	return fmt.Sprintf("%s %q last seen %s", device.DeviceID, device.DisplayName, lastseen)
+}
+
+type mxRespDevices struct {
+	Devices []mxDevice `json:"devices"`
+}
+
+/// the user interactive auth session the server hands out with its 401
+type mxRespUserInteractive struct {
+	Session string `json:"session"`
+}
+
+func mxWhoami(cli *gomatrix.Client) (mxRespWhoami, error) {
+	var whoami mxRespWhoami
+	err := cli.MakeRequest(http.MethodGet, cli.BuildURL("account", "whoami"), nil, &whoami)
+	return whoami, err
+}
+
+/// true if the server told us our access token is no good, as opposed to not answering at all
+func mxIsUnauthorized(err error) bool {
+	httperr, ok := err.(gomatrix.HTTPError)
+	return ok && (httperr.Code == http.StatusUnauthorized || httperr.Code == http.StatusForbidden)
+}
+
+/// give cli the credentials of a configured or stored session, or log in with the password and store that session
+func mxLogin(cli *gomatrix.Client) (MxSession, error) {
+	homeserver := c["matrix"]["url"]
+	configured_device_id := strings.TrimSpace(c.GetValueDefault("matrix", "device_id", ""))
+
+	if token := strings.TrimSpace(c.GetValueDefault("matrix", "access_token", "")); len(token) > 0 {
+		cli.SetCredentials(c["matrix"]["user"], token)
+		whoami, err := mxWhoami(cli)
+		if err != nil {
+			return MxSession{}, fmt.Errorf("[matrix]access_token: %s", err)
+		}
+		session := MxSession{HomeserverURL: homeserver, UserID: whoami.UserID, AccessToken: token, DeviceID: whoami.DeviceID}
+		if len(configured_device_id) > 0 {
+			session.DeviceID = configured_device_id
+		}
+		cli.SetCredentials(session.UserID, token)
+		mx_user_id_ = session.UserID
+		return session, nil
+	}
+
+	var stored MxSession
+	if loadStateFile(mx_session_filename_, &stored) && stored.HomeserverURL == homeserver && len(stored.AccessToken) > 0 {
+		cli.SetCredentials(stored.UserID, stored.AccessToken)
+		whoami, err := mxWhoami(cli)
+		if err == nil && whoami.UserID == stored.UserID {
+			mx_user_id_ = stored.UserID
+			return stored, nil
+		}
+		/// if the server is down, a password login won't work either
+		if err != nil && !mxIsUnauthorized(err) {
+			return MxSession{}, err
+		}
+		cli.ClearCredentials()
+	}
+
+	if len(c.GetValueDefault("matrix", "password", "")) == 0 {
+		return MxSession{}, fmt.Errorf("ERROR: need [matrix]access_token or [matrix]password to log in")
+	}
+	device_id := configured_device_id
+	if len(device_id) == 0 && stored.HomeserverURL == homeserver {
+		device_id = stored.DeviceID
+	}
+	resp, err := cli.Login(&gomatrix.ReqLogin{
+		Type:                     "m.login.password",
+		User:                     c["matrix"]["user"],
+		Password:                 c["matrix"]["password"],
+		DeviceID:                 device_id,
+		InitialDeviceDisplayName: mx_device_display_name_,
+	})
+	if err != nil {
+		return MxSession{}, err
+	}
+	cli.SetCredentials(resp.UserID, resp.AccessToken)
+	mx_user_id_ = resp.UserID
+	session := MxSession{HomeserverURL: homeserver, UserID: resp.UserID, AccessToken: resp.AccessToken, DeviceID: resp.DeviceID}
+	saveStateFile(mx_session_filename_, session)
+	return session, nil
+}
+
+/// mycete -logout: end the session stored in [state]dir and forget it. A configured access_token is left alone.
+func mxLogoutStoredSession() error {
+	var stored MxSession
+	if !loadStateFile(mx_session_filename_, &stored) {
+		return fmt.Errorf("no stored matrix session in [state]dir")
+	}
+	cli, err := gomatrix.NewClient(stored.HomeserverURL, stored.UserID, stored.AccessToken)
+	if err != nil {
+		return err
+	}
+	/// a token the server no longer knows is as good as logged out
+	if _, err = cli.Logout(); err != nil && !mxIsUnauthorized(err) {
+		return err
+	}
+	fmt.Printf("Logged out device %s of %s\n", stored.DeviceID, stored.UserID)
+	return os.Remove(path.Join(state_dir_, mx_session_filename_))
+}
+
+/// mycete -cleanup-devices: list all devices of our user named like ours or not named at all, as password logins of
+/// earlier versions left them, except the one we are using. Other clients may leave devices unnamed too,
+/// so only with confirm we delete them, which needs [matrix]password.
+func mxCleanupDevices(confirm bool) error {
+	cli, err := gomatrix.NewClient(c["matrix"]["url"], "", "")
+	if err != nil {
+		return err
+	}
+	session, err := mxLogin(cli)
+	if err != nil {
+		return err
+	}
+	var devices mxRespDevices
+	if err = cli.MakeRequest(http.MethodGet, cli.BuildURL("devices"), nil, &devices); err != nil {
+		return err
+	}
+	stale := make([]string, 0, len(devices.Devices))
+	for _, device := range devices.Devices {
+		if device.DeviceID != session.DeviceID && (device.DisplayName == mx_device_display_name_ || len(device.DisplayName) == 0) {
+			fmt.Println(device)
+			stale = append(stale, device.DeviceID)
+		}
+	}
+	if len(stale) == 0 {
+		fmt.Println("No stale devices")
+		return nil
+	}
+	if !confirm {
+		fmt.Printf("Run again with -cleanup-devices -confirm to delete these %d devices. Make sure none of them is someone elses!\n", len(stale))
+		return nil
+	}
+	if len(c.GetValueDefault("matrix", "password", "")) == 0 {
+		return fmt.Errorf("deleting %d stale devices needs [matrix]password", len(stale))
+	}
+	/// the first request only gets us the user interactive auth session to send the password with
+	req := map[string]interface{}{"devices": stale}
+	err = cli.MakeRequest(http.MethodPost, cli.BuildURL("delete_devices"), req, nil)
+	if err == nil {
+		fmt.Printf("Deleted %d stale devices\n", len(stale))
+		return nil
+	}
+	httperr, ok := err.(gomatrix.HTTPError)
+	if !ok || httperr.Code != http.StatusUnauthorized {
+		return err
+	}
+	var uia mxRespUserInteractive
+	if err = json.Unmarshal(httperr.Contents, &uia); err != nil {
+		return err
+	}
+	req["auth"] = map[string]interface{}{
+		"type":       "m.login.password",
+		"identifier": map[string]string{"type": "m.id.user", "user": session.UserID},
+		"password":   c["matrix"]["password"],
+		"session":    uia.Session,
+	}
+	if err = cli.MakeRequest(http.MethodPost, cli.BuildURL("delete_devices"), req, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d stale devices\n", len(stale))
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+/// A restart must never publish anything twice. So we keep the sync token (next_batch) in [state]dir and continue from it,
+/// and on the first sync after starting we only log events from before we started instead of acting on them,
+/// whether they are old timeline the server sends along or messages that came in while we were down.
+
+const mx_sync_filename_ string = "matrixsync.json"
+
+var process_start_ time.Time = time.Now()
+
+/// gomatrix.InMemoryStore, except the next_batch token of each user survives restarts
+type mxStateStore struct {
+	*gomatrix.InMemoryStore
+}
+
+func newMxStateStore() *mxStateStore {
+	store := &mxStateStore{InMemoryStore: gomatrix.NewInMemoryStore()}
+	loadStateFile(mx_sync_filename_, &store.NextBatch)
+	if store.NextBatch == nil {
+		store.NextBatch = make(map[string]string)
+	}
+	return store
+}
+
+/// only called from the Sync() goroutine
+func (s *mxStateStore) SaveNextBatch(userid, nextbatch string) {
+	s.InMemoryStore.SaveNextBatch(userid, nextbatch)
+	saveStateFile(mx_sync_filename_, s.NextBatch)
+}
+
+/// gomatrix.DefaultSyncer, except the first response we process drops events older than process_start_
+type mxStartupSyncer struct {
+	*gomatrix.DefaultSyncer
+	synced bool
+}
+
+func (s *mxStartupSyncer) ProcessResponse(resp *gomatrix.RespSync, since string) error {
+	if !s.synced {
+		s.synced = true
+		mxDropEventsBefore(resp, process_start_)
+	}
+	return s.DefaultSyncer.ProcessResponse(resp, since)
+}
+
+func mxDropEventsBefore(resp *gomatrix.RespSync, start time.Time) {
+	startms := start.UnixNano() / int64(time.Millisecond)
+	for roomid, roomdata := range resp.Rooms.Join {
+		events := roomdata.Timeline.Events[:0]
+		for _, ev := range roomdata.Timeline.Events {
+			if ev.Timestamp < startms {
+				if roomid == c["matrix"]["room_id"] {
+					log.Printf("ignoring %s %s from %s, sent %s before we started", ev.Type, ev.ID, ev.Sender, time.Unix(0, ev.Timestamp*int64(time.Millisecond)).Format(time.RFC3339))
+				}
+				continue
+			}
+			events = append(events, ev)
+		}
+		roomdata.Timeline.Events = events
+		resp.Rooms.Join[roomid] = roomdata
+	}
+}
+
+/// give cli a store that persists the sync token and a syncer that knows our user id and ignores the backlog.
+/// Call after logging in.
+func mxSetupSync(cli *gomatrix.Client) *gomatrix.DefaultSyncer {
+	store := newMxStateStore()
+	defaultsyncer := gomatrix.NewDefaultSyncer(cli.UserID, store)
+	cli.Store = store
+	cli.Syncer = &mxStartupSyncer{DefaultSyncer: defaultsyncer}
+	return defaultsyncer
+}
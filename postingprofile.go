@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/// A PostingProfile is a prefix that posts to its own set of networks with its own defaults.
+/// [matrix]guard_prefix is the default profile posting to all enabled networks,
+/// further profiles are configured in sections [profile_<name>], e.g.
+///    [profile_mastodononly]
+///    prefix=m>
+///    networks=mastodon
+///    visibility=unlisted
+///    cw=
+///    language=en
+///    hashtags=#realraum #vienna
+type PostingProfile struct {
+	Name        string
+	Prefix      string
+	Networks    []string // empty for all enabled networks
+	Visibility  string
+	SpoilerText string
+	Language    string
+	Hashtags    []string
+}
+
+const posting_profile_section_prefix_ string = "profile_"
+const default_posting_profile_name_ string = "default"
+
+/// all profiles, longest prefix first so that e.g. "all>" is not mistaken for "a>"
+var posting_profiles_ []*PostingProfile
+
+func initPostingProfiles() {
+	posting_profiles_ = []*PostingProfile{{Name: default_posting_profile_name_, Prefix: guard_prefix_}}
+	for _, section := range c.ListSections() {
+		if !strings.HasPrefix(section, posting_profile_section_prefix_) {
+			continue
+		}
+		profile := &PostingProfile{
+			Name:        strings.TrimPrefix(section, posting_profile_section_prefix_),
+			Prefix:      strings.TrimSpace(c.GetValueDefault(section, "prefix", "")),
+			SpoilerText: strings.TrimSpace(c.GetValueDefault(section, "cw", "")),
+			Language:    strings.TrimSpace(c.GetValueDefault(section, "language", "")),
+			Hashtags:    strings.Fields(c.GetValueDefault(section, "hashtags", "")),
+		}
+		if profile.Name == default_posting_profile_name_ {
+			panic(fmt.Sprintf("ERROR: [%s] is reserved for guard_prefix", section))
+		}
+		if len(profile.Prefix) == 0 {
+			panic(fmt.Sprintf("ERROR: [%s] needs a prefix", section))
+		}
+		for _, network := range strings.Split(c.GetValueDefault(section, "networks", ""), ",") {
+			network = strings.TrimSpace(network)
+			if len(network) == 0 {
+				continue
+			}
+			if getPublisher(network) == nil {
+				panic(fmt.Sprintf("ERROR: [%s] posts to %s, which is not enabled in [server]", section, network))
+			}
+			profile.Networks = append(profile.Networks, network)
+		}
+		if visibility := strings.TrimSpace(c.GetValueDefault(section, "visibility", "")); len(visibility) > 0 {
+			opts := PostOptions{}
+			if err := parseVisibilityOption(visibility, &opts); err != nil {
+				panic(fmt.Sprintf("ERROR: [%s] %s", section, err.Error()))
+			}
+			profile.Visibility = opts.Visibility
+		}
+		for idx, hashtag := range profile.Hashtags {
+			if !strings.HasPrefix(hashtag, "#") {
+				profile.Hashtags[idx] = "#" + hashtag
+			}
+		}
+		posting_profiles_ = append(posting_profiles_, profile)
+	}
+	sort.SliceStable(posting_profiles_, func(i, j int) bool {
+		return len(posting_profiles_[i].Prefix) > len(posting_profiles_[j].Prefix)
+	})
+}
+
+/// all prefixes a matrix message can start with to make us do something, they MUST differ
+func checkPrefixesDiffer() {
+	//https://chaos.social/@realraum/101880653017828628
+	const mustdiffer = "ERROR: guard_prefix, reblog_cmd, favourite_cmd, schedule_cmd, alt_cmd or profile prefixes MUST differ"
+	seen := make(map[string]string, len(posting_profiles_)+4)
+	for _, cmd := range []struct{ prefix, name string }{
+		{reblog_cmd_, "reblog_cmd"},
+		{favourite_cmd_, "favourite_cmd"},
+		{schedule_cmd_, "schedule_cmd"},
+		{alt_cmd_, "alt_cmd"},
+	} {
+		if other, inmap := seen[cmd.prefix]; inmap {
+			panic(fmt.Sprintf("%s. %s is the same as %s", mustdiffer, cmd.name, other))
+		}
+		seen[cmd.prefix] = cmd.name
+	}
+	for _, profile := range posting_profiles_ {
+		if other, inmap := seen[profile.Prefix]; inmap {
+			panic(fmt.Sprintf("%s. Profile %s uses the same prefix as %s", mustdiffer, profile.Name, other))
+		}
+		seen[profile.Prefix] = "profile " + profile.Name
+	}
+}
+
+func getDefaultPostingProfile() *PostingProfile {
+	for _, profile := range posting_profiles_ {
+		if profile.Name == default_posting_profile_name_ {
+			return profile
+		}
+	}
+	return nil
+}
+
+/// returns the profile whose prefix post starts with, or nil
+func matchPostingProfile(post string) *PostingProfile {
+	for _, profile := range posting_profiles_ {
+		if strings.HasPrefix(post, profile.Prefix) {
+			return profile
+		}
+	}
+	return nil
+}
+
+/// the enabled Publishers this profile posts to
+func (profile *PostingProfile) Publishers() []Publisher {
+	if len(profile.Networks) == 0 {
+		return publishers_
+	}
+	return publishersByName(profile.Networks)
+}
+
+/// strip the prefix from post, parse the options and fill in whatever the user did not set with the profiles defaults
+func (profile *PostingProfile) ParsePost(post string) (string, PostOptions, error) {
+	return profile.ParseText(post[len(profile.Prefix):])
+}
+
+/// like ParsePost for the question of a poll, which may also have poll options like expires:
+func (profile *PostingProfile) ParsePollPost(post string) (string, PostOptions, error) {
+	return profile.parseText(post[len(profile.Prefix):], true)
+}
+
+/// like ParsePost for text without prefix
+func (profile *PostingProfile) ParseText(text string) (string, PostOptions, error) {
+	return profile.parseText(text, false)
+}
+
+func (profile *PostingProfile) parseText(text string, ispoll bool) (string, PostOptions, error) {
+	post, opts, err := parsePostOptions(strings.TrimSpace(text), ispoll)
+	if err != nil {
+		return post, opts, err
+	}
+	/// kept apart from what the user typed, so replies to followers-only or direct status don't become more visible
+	opts.DefaultVisibility = profile.Visibility
+	if len(opts.SpoilerText) == 0 {
+		opts.SpoilerText = profile.SpoilerText
+	}
+	if len(opts.Language) == 0 {
+		opts.Language = profile.Language
+	}
+	for _, hashtag := range profile.Hashtags {
+		if !strings.Contains(strings.ToLower(post), strings.ToLower(hashtag)) {
+			post += " " + hashtag
+		}
+	}
+	return post, opts, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/// Users may start their post (after the guard_prefix) with options, each ended by a '|', e.g.
+///    t> cw: politics | sensitive | vis: unlisted | the actual text
+/// We stop at the first part that is not an option we know, so text containing '|' is fine.
+
+const post_option_separator_ string = "|"
+
+type postOptionParser func(value string, opts *PostOptions) error
+
+var post_option_parsers_ = map[string]postOptionParser{
+	"cw": func(value string, opts *PostOptions) error {
+		if len(value) == 0 {
+			return fmt.Errorf("cw: needs a topic")
+		}
+		opts.SpoilerText = value
+		return nil
+	},
+	"sensitive": func(value string, opts *PostOptions) error {
+		opts.Sensitive = true
+		return nil
+	},
+	"lang": func(value string, opts *PostOptions) error {
+		if len(value) < 2 || len(value) > 3 {
+			return fmt.Errorf("lang: needs an ISO 639 language code like en or de")
+		}
+		opts.Language = strings.ToLower(value)
+		return nil
+	},
+	"visibility": parseVisibilityOption,
+	"vis":        parseVisibilityOption,
+}
+
+/// only make sense when starting a poll
+var poll_option_parsers_ = map[string]postOptionParser{
+	"expires": parsePollExpiresOption,
+}
+
+var visibility_option_names_ = map[string]string{
+	"public":         visibility_public_,
+	"unlisted":       visibility_unlisted_,
+	"private":        visibility_private_,
+	"followers":      visibility_private_,
+	"followers-only": visibility_private_,
+	"direct":         visibility_direct_,
+	"dm":             visibility_direct_,
+}
+
+/// how long a poll runs, e.g. 30m, 12h or 3d
+func parsePollDuration(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("expires: %s is not a number of days", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("expires: needs a duration like 30m, 12h or 3d")
+	}
+	return duration, nil
+}
+
+func parsePollExpiresOption(value string, opts *PostOptions) error {
+	duration, err := parsePollDuration(value)
+	if err != nil {
+		return err
+	}
+	if opts.Poll == nil {
+		opts.Poll = &PostPoll{}
+	}
+	opts.Poll.ExpiresIn = duration
+	return nil
+}
+
+func parseVisibilityOption(value string, opts *PostOptions) error {
+	visibility, known := visibility_option_names_[strings.ToLower(value)]
+	if !known {
+		return fmt.Errorf("visibility: must be one of public, unlisted, followers-only or direct")
+	}
+	opts.Visibility = visibility
+	return nil
+}
+
+/// splits "key: value" or "flag" into key and value
+func splitPostOption(option string) (key, value string) {
+	option = strings.TrimSpace(option)
+	if idx := strings.Index(option, ":"); idx >= 0 {
+		return strings.ToLower(strings.TrimSpace(option[:idx])), strings.TrimSpace(option[idx+1:])
+	}
+	return strings.ToLower(option), ""
+}
+
+/// parse options at the beginning of post, returns the remaining text. Poll options are refused unless ispoll.
+func parsePostOptions(post string, ispoll bool) (string, PostOptions, error) {
+	opts := PostOptions{}
+	for {
+		idx := strings.Index(post, post_option_separator_)
+		if idx < 0 {
+			return post, opts, nil
+		}
+		key, value := splitPostOption(post[:idx])
+		parser, known := post_option_parsers_[key]
+		if pollparser, ispolloption := poll_option_parsers_[key]; ispolloption {
+			if !ispoll {
+				return post, opts, fmt.Errorf("%s: only works when starting a poll", key)
+			}
+			parser, known = pollparser, true
+		}
+		if !known {
+			return post, opts, nil
+		}
+		if err := parser(value, &opts); err != nil {
+			return post, opts, err
+		}
+		post = strings.TrimSpace(post[idx+len(post_option_separator_):])
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/// A Publisher is a microblogging network we can post to and act on status of.
+/// Status IDs are passed around as strings, each Publisher converts them into whatever its network needs.
+type Publisher interface {
+	Name() string       // network name, e.g. mastodon_net, also the key in [server]
+	StatusNoun() string // what the network calls a status, e.g. "toot" or "tweet"
+	Accepts(opts PostOptions) error
+	PrepareText(post string, opts PostOptions) (text string, reserved int) // text to Post and characters opts use up besides it
+	Post(text, matrixnick string, opts PostOptions) (weburl string, statusid string, err error)
+	Delete(statusid string) error
+	Reblog(statusid string) error
+	Unreblog(statusid string) error
+	Favourite(statusid string) error
+	Unfavourite(statusid string) error
+	CharacterLimit() int
+	CountCharacters(status string) int // count the way the network does
+	SupportsMediaType(mimetype string) bool
+	MediaBytesLimit(mimetype string) int64
+	MediaDurationLimit(mimetype string) time.Duration    // zero if there is none
+	ImageDimensionLimit() (maxside int, maxpixels int64) // zero if there is none
+	ImageCountLimit() int
+}
+
+/// mastodon visibilities, networks without them only get public and unlisted posts
+const (
+	visibility_public_   string = "public"
+	visibility_unlisted_ string = "unlisted"
+	visibility_private_  string = "private" // followers-only
+	visibility_direct_   string = "direct"
+)
+
+/// true if the status must not end up anywhere everybody can see it
+func isRestrictedVisibility(visibility string) bool {
+	return visibility == visibility_private_ || visibility == visibility_direct_
+}
+
+/// the higher, the fewer people see it
+var visibility_narrowness_ = map[string]int{
+	visibility_public_:   1,
+	visibility_unlisted_: 2,
+	visibility_private_:  3,
+	visibility_direct_:   4,
+}
+
+/// per post settings, given to each Publisher with the ids of its own network
+type PostOptions struct {
+	InReplyTo         string // status id on this network we reply to, may be empty
+	Visibility        string // mastodon visibility the user asked for, empty for DefaultVisibility or that of InReplyTo
+	DefaultVisibility string // of the posting profile, empty for the accounts default
+	ReplyToMirrored   bool   // InReplyTo is someone elses status. Mention its participants and keep its visibility
+	SpoilerText       string // content warning
+	Sensitive         bool   // media is sensitive
+	Language          string // ISO 639 language code, empty to let the network guess
+	Poll              *PostPoll
+}
+
+/// the visibility to post with: what the user asked for, else the profiles default,
+/// unless we reply to a followers-only or direct status (parentvisibility, empty if unknown or no reply) that sees fewer people
+func (opts PostOptions) visibilityFor(parentvisibility string) string {
+	if len(opts.Visibility) > 0 {
+		return opts.Visibility
+	}
+	if isRestrictedVisibility(parentvisibility) && visibility_narrowness_[parentvisibility] > visibility_narrowness_[opts.DefaultVisibility] {
+		return parentvisibility
+	}
+	return opts.DefaultVisibility
+}
+
+type PostPoll struct {
+	Options    []string
+	Multiple   bool          // voters may choose more than one option
+	HideTotals bool          // don't show results until the poll ended
+	ExpiresIn  time.Duration // zero for [matrix]poll_duration
+}
+
+/// Publishers whose network can change a status in place also implement StatusEditor.
+/// Edit returns err_edit_not_supported_ if the server turns out not to be able to, then we repost like for networks that can't edit.
+type StatusEditor interface {
+	Edit(statusid, text string, opts PostOptions) (weburl string, err error)
+}
+
+var err_edit_not_supported_ error = fmt.Errorf("server can't edit")
+
+/// Publishers whose network can't (always) edit tell us what a status replied to and whether it has media,
+/// so editOrRepost can post the new one in the same place or refuse
+type StatusReposter interface {
+	RepostContext(statusid string) (RepostInfo, error)
+}
+
+type RepostInfo struct {
+	InReplyTo       string // empty if the status is no reply
+	ReplyToMirrored bool   // InReplyTo is someone elses status and the status mentions its participants, so must the repost
+	HasMedia        bool   // we can't repost media, it's gone from the media store
+}
+
+/// Publishers whose network can publish a status at a given time on its own also implement StatusScheduler.
+/// Everything else is scheduled by us.
+type StatusScheduler interface {
+	Schedule(text, matrixnick string, opts PostOptions, at time.Time) (scheduledid string, err error)
+	CancelScheduled(scheduledid string) error
+	FindScheduledStatus(scheduledid string, at time.Time, opts PostOptions) (statusid string, err error) // empty while not yet published
+}
+
+type publisherFactory func() Publisher
+
+/// all networks we know about, in the order we post to them
+var publisher_registry_names_ = []string{mastodon_net, twitter_net}
+
+var publisher_registry_ = map[string]publisherFactory{
+	mastodon_net: func() Publisher { return newMastodonPublisher(initMastodonClient()) },
+	twitter_net:  func() Publisher { return newTwitterPublisher(initTwitterClient()) },
+}
+
+/// enabled Publishers, set up by initPublishers according to [server]
+var publishers_ []Publisher
+
+func initPublishers() {
+	publishers_ = nil
+	for _, name := range publisher_registry_names_ {
+		if c.GetValueDefault("server", name, "false") != "true" {
+			continue
+		}
+		factory, inmap := publisher_registry_[name]
+		if !inmap {
+			panic("no publisher registered for network " + name)
+		}
+		publishers_ = append(publishers_, factory())
+	}
+}
+
+/// returns the enabled Publisher for network name or nil
+func getPublisher(name string) Publisher {
+	for _, p := range publishers_ {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+/// the enabled Publishers among names, in the order we post to them
+func publishersByName(names []string) []Publisher {
+	rv := make([]Publisher, 0, len(names))
+	for _, p := range publishers_ {
+		for _, name := range names {
+			if p.Name() == name {
+				rv = append(rv, p)
+			}
+		}
+	}
+	return rv
+}
+
+func getPublisherOrError(name string) (Publisher, error) {
+	if p := getPublisher(name); p != nil {
+		return p, nil
+	}
+	return nil, fmt.Errorf("%s is not enabled in [server]", name)
+}
+
+/// post text, split into a thread if enabled and needed. Each part replies to the one before.
+/// Images and polls are only attached to the first part. Returns the ids of everything we managed to post, even on error.
+func publishThread(p Publisher, post, matrixnick string, opts PostOptions) (weburl string, statusids []string, err error) {
+	text, reserved := p.PrepareText(post, opts)
+	parts := []string{text}
+	if split_into_thread_ {
+		parts = splitIntoThread(text, p.CharacterLimit()-reserved, p.CountCharacters)
+	}
+	for idx, part := range parts {
+		var partweburl, statusid string
+		partweburl, statusid, err = p.Post(part, matrixnick, opts)
+		if err != nil {
+			return
+		}
+		if idx == 0 {
+			weburl = partweburl
+		}
+		statusids = append(statusids, statusid)
+		matrixnick = ""
+		opts.InReplyTo = statusid
+		opts.ReplyToMirrored = false
+		opts.Poll = nil
+	}
+	return
+}
+
+/// change the text of an already published status.
+/// If the network or server can't edit, we post the new text and delete the old status, thus the status id may change.
+func editOrRepost(p Publisher, statusid, post string, opts PostOptions) (weburl string, newstatusid string, reposted bool, err error) {
+	text, _ := p.PrepareText(post, opts)
+	if editor, canedit := p.(StatusEditor); canedit {
+		weburl, err = editor.Edit(statusid, text, opts)
+		if err != err_edit_not_supported_ {
+			return weburl, statusid, false, err
+		}
+		log.Printf("editOrRepost: %s can't edit, reposting %s", p.Name(), statusid)
+		err = nil
+	}
+	if reposter, canrepost := p.(StatusReposter); canrepost {
+		info, ctxerr := reposter.RepostContext(statusid)
+		if ctxerr != nil {
+			return "", statusid, false, ctxerr
+		}
+		if info.HasMedia {
+			return "", statusid, false, fmt.Errorf("can't edit a %s with images or video without losing them. Please redact your message and post it again", p.StatusNoun())
+		}
+		opts.InReplyTo = info.InReplyTo
+		opts.ReplyToMirrored = info.ReplyToMirrored
+	}
+	// no matrixnick: we don't want to attach images the user queued for their next post to the repost
+	if weburl, newstatusid, err = p.Post(text, "", opts); err != nil {
+		return
+	}
+	reposted = true
+	if delerr := p.Delete(statusid); delerr != nil {
+		log.Printf("editOrRepost: could not delete old %s %s: %s", p.StatusNoun(), statusid, delerr)
+	}
+	return
+}
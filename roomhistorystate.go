@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+)
+
+/// If [state]rebuild_from_room is enabled, every confirmation we send after posting, reblogging or favouriting
+/// carries the resulting status in machine readable form and relates to the users original event.
+/// On startup we read back through the controlling room and rebuild the message to status store from that.
+
+const mycete_status_content_key_ string = "org.mycete.status"
+const rebuild_history_page_size_ int = 100
+
+var msgstatusaction_names_ = map[MsgStatusDataAction]string{
+	actionPost:   "post",
+	actionReblog: "reblog",
+	actionFav:    "favourite",
+	actionMirror: "mirror",
+}
+
+type MyceteStatusInfo struct {
+	MatrixUser string   `json:"matrix_user"`
+	Action     string   `json:"action"`
+	Network    string   `json:"network"`
+	StatusID   string   `json:"status_id"`
+	ThreadIDs  []string `json:"thread_status_ids,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	Visibility string   `json:"visibility,omitempty"`
+}
+
+type MxStatusNotice struct {
+	MsgType      string           `json:"msgtype"`
+	Body         string           `json:"body"`
+	RelatesTo    MxRelatesTo      `json:"m.relates_to"`
+	MyceteStatus MyceteStatusInfo `json:"org.mycete.status"`
+}
+
+func parseMsgStatusDataAction(name string) (MsgStatusDataAction, bool) {
+	for action, actionname := range msgstatusaction_names_ {
+		if actionname == name {
+			return action, true
+		}
+	}
+	return actionPost, false
+}
+
+/// like mxNotify, but tells future instances of us which status resulted from which matrix event
+func mxNotifyStatus(client *gomatrix.Client, from, msg, eventid string, data MsgStatusData, network, weburl string) {
+	if c.GetValueDefault("state", "rebuild_from_room", "false") != "true" {
+		mxNotify(client, from, msg)
+		return
+	}
+	log.Printf("%s: %s\n", from, msg)
+	client.SendMessageEvent(c["matrix"]["room_id"], "m.room.message", MxStatusNotice{
+		MsgType:   "m.text",
+		Body:      msg,
+		RelatesTo: MxRelatesTo{RelType: "m.reference", EventID: eventid},
+		MyceteStatus: MyceteStatusInfo{
+			MatrixUser: data.MatrixUser,
+			Action:     msgstatusaction_names_[data.Action],
+			Network:    network,
+			StatusID:   data.StatusIDs[network],
+			ThreadIDs:  data.ThreadStatusIDs[network],
+			URL:        weburl,
+			Visibility: data.Visibility,
+		},
+	})
+}
+
+/// walk backwards through the controlling room until we hit the retention window
+/// and collect everything our confirmations tell us about matrix events and their status
+func rebuildRUMSFromRoomHistory(mxcli *gomatrix.Client) map[string]MsgStatusData {
+	roomid := c["matrix"]["room_id"]
+	found := make(map[string]MsgStatusData, 100)
+	redacted := make(map[string]bool, 10)
+
+	filter, _ := json.Marshal(map[string]interface{}{
+		"room": map[string]interface{}{
+			"rooms":    []string{roomid},
+			"timeline": map[string]interface{}{"limit": 1},
+		},
+	})
+	resp, err := mxcli.SyncRequest(0, "", string(filter), false, "")
+	if err != nil {
+		log.Println("rebuildRUMSFromRoomHistory:", err)
+		return found
+	}
+	joinedroom, inmap := resp.Rooms.Join[roomid]
+	if !inmap {
+		return found
+	}
+	events := joinedroom.Timeline.Events
+	from := joinedroom.Timeline.PrevBatch
+
+	var cutoff int64 = 0
+	if rums_retention_ > 0 {
+		cutoff = time.Now().Add(-rums_retention_).UnixNano() / int64(time.Millisecond)
+	}
+
+HISTORYFOR:
+	for {
+		for _, ev := range events {
+			if ev.Timestamp < cutoff {
+				break HISTORYFOR
+			}
+			if ev.Type == "m.room.redaction" {
+				redacted[ev.Redacts] = true
+				continue
+			}
+			if ev.Type != "m.room.message" || ev.Sender != mxcli.UserID {
+				continue
+			}
+			statusinfo_i, inmap := ev.Content[mycete_status_content_key_]
+			if !inmap {
+				continue
+			}
+			var statusinfo MyceteStatusInfo
+			if err := mxContentToStruct(statusinfo_i, &statusinfo); err != nil || len(statusinfo.StatusID) == 0 {
+				continue
+			}
+			relation, hasrelation := mxGetRelatesTo(&ev)
+			if !hasrelation || len(relation.EventID) == 0 {
+				continue
+			}
+			action, actionok := parseMsgStatusDataAction(statusinfo.Action)
+			if !actionok {
+				continue
+			}
+			rums, inmap := found[relation.EventID]
+			if !inmap {
+				rums = MsgStatusData{
+					MatrixUser:      statusinfo.MatrixUser,
+					StatusIDs:       make(map[string]string, 2),
+					ThreadStatusIDs: make(map[string][]string),
+					Action:          action,
+					Visibility:      statusinfo.Visibility,
+					Stored:          time.Unix(0, ev.Timestamp*int64(time.Millisecond)),
+				}
+			}
+			if _, inmap := rums.StatusIDs[statusinfo.Network]; !inmap { //we walk backwards, newest (e.g. reposted after edit) wins
+				rums.StatusIDs[statusinfo.Network] = statusinfo.StatusID
+				if len(statusinfo.ThreadIDs) > 0 {
+					rums.ThreadStatusIDs[statusinfo.Network] = statusinfo.ThreadIDs
+				}
+			}
+			found[relation.EventID] = rums
+		}
+		if len(from) == 0 {
+			break
+		}
+		msgs, err := mxcli.Messages(roomid, from, "", 'b', rebuild_history_page_size_)
+		if err != nil {
+			log.Println("rebuildRUMSFromRoomHistory:", err)
+			break
+		}
+		if len(msgs.Chunk) == 0 || msgs.End == from {
+			break
+		}
+		events = msgs.Chunk
+		from = msgs.End
+	}
+
+	/// statuses whose matrix message was redacted have already been taken back
+	for eventid := range redacted {
+		delete(found, eventid)
+	}
+	log.Printf("rebuildRUMSFromRoomHistory: found %d matrix messages with status", len(found))
+	return found
+}
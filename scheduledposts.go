@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// Posts scheduled from matrix. Networks that can publish at a given time themselves (StatusScheduler) get the post right away,
+/// for all others we keep the post (and the images queued with it) in the state dir and publish it when it is due.
+/// A post stays in the state dir until publishing it is over, so a crash or restart meanwhile publishes it again
+/// rather than losing it. Each network is dropped from it as soon as it is done though, so that only happens
+/// on networks that did not have it yet.
+
+const scheduled_posts_filename_ string = "scheduledposts.json"
+const scheduled_media_dirname_ string = "scheduledmedia"
+const scheduler_check_interval_ time.Duration = 20 * time.Second
+const scheduled_status_find_tries_ int = 30
+
+type ScheduledPost struct {
+	Number     int // what users call it in the list and cancel commands
+	EventID    string
+	MatrixUser string
+	Due        time.Time
+	Text       string
+	Options    PostOptions
+	Networks   []string          // networks we publish to ourselves when due
+	NativeIDs  map[string]string // network -> scheduled status id of networks that publish on their own
+	HasMedia   bool
+	/// what networks we are done with published, in case we crash before the rest is
+	StatusIDs       map[string]string   `json:",omitempty"`
+	ThreadStatusIDs map[string][]string `json:",omitempty"`
+}
+
+/// images queued with the post wait under this made up nick until we publish
+func (sp *ScheduledPost) MediaNick() string {
+	return "scheduled " + sp.EventID
+}
+
+func (sp *ScheduledPost) String() string {
+	networks := append([]string{}, sp.Networks...)
+	for network := range sp.NativeIDs {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	summary := []rune(sp.Text)
+	if len(summary) > 60 {
+		summary = append(summary[:59], '…')
+	}
+	return fmt.Sprintf("#%d at %s to %s by %s: %s", sp.Number, sp.Due.In(schedule_location_).Format("2006-01-02 15:04 MST"), strings.Join(networks, ", "), sp.MatrixUser, string(summary))
+}
+
+type PostScheduler struct {
+	lock        sync.Mutex
+	posts       map[string]*ScheduledPost // key is the matrix event id
+	last_number int
+	publish     func(ScheduledPost, func(network string, rums *MsgStatusData))
+	media       MediaStore
+	publishing  map[string]bool // event ids of due posts we are publishing right now
+}
+
+/// load pending posts from the state dir and publish each one using publish when due.
+/// publish calls the func it gets whenever a network is done, with the status ids published so far.
+func taskRunPostScheduler(publish func(ScheduledPost, func(network string, rums *MsgStatusData))) *PostScheduler {
+	ps := &PostScheduler{posts: make(map[string]*ScheduledPost, 10), publish: publish, media: scheduledMediaStore(), publishing: make(map[string]bool, 10)}
+	ps.load()
+	go func() {
+		for range time.Tick(scheduler_check_interval_) {
+			for _, sp := range ps.takeDue(time.Now()) {
+				go func(sp ScheduledPost) {
+					if err := ps.restoreMedia(&sp); err != nil {
+						log.Println("PostScheduler: could not restore images:", err)
+					}
+					ps.publish(sp, func(network string, rums *MsgStatusData) { ps.networkDone(sp.EventID, network, rums) })
+					ps.done(sp)
+				}(sp)
+			}
+		}
+	}()
+	return ps
+}
+
+/// with a state dir, media of scheduled posts survives restarts there.
+/// Media is kept by the event id of the schedule command.
+func scheduledMediaStore() MediaStore {
+	if len(state_dir_) > 0 {
+		return newDirMediaStore(path.Join(state_dir_, scheduled_media_dirname_))
+	}
+	return media_store_
+}
+
+func (ps *PostScheduler) load() {
+	var posts []*ScheduledPost
+	if !loadStateFile(scheduled_posts_filename_, &posts) {
+		return
+	}
+	for _, sp := range posts {
+		ps.posts[sp.EventID] = sp
+		if sp.Number > ps.last_number {
+			ps.last_number = sp.Number
+		}
+	}
+}
+
+/// call with ps.lock held
+func (ps *PostScheduler) save() {
+	posts := make([]*ScheduledPost, 0, len(ps.posts))
+	for _, sp := range ps.posts {
+		posts = append(posts, sp)
+	}
+	saveStateFile(scheduled_posts_filename_, posts)
+}
+
+/// return all posts due at now we are not publishing yet. They stay scheduled until done is called.
+func (ps *PostScheduler) takeDue(now time.Time) []ScheduledPost {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	var due []ScheduledPost
+	for eventid, sp := range ps.posts {
+		if !sp.Due.After(now) && !ps.publishing[eventid] {
+			due = append(due, *sp)
+			ps.publishing[eventid] = true
+		}
+	}
+	return due
+}
+
+/// network published the post scheduled by eventid or failed to, either way don't publish it there again after a restart
+func (ps *PostScheduler) networkDone(eventid, network string, rums *MsgStatusData) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	sp, inmap := ps.posts[eventid]
+	if !inmap {
+		return
+	}
+	networks := make([]string, 0, len(sp.Networks)) // the copy we are publishing shares sp.Networks
+	for _, name := range sp.Networks {
+		if name != network {
+			networks = append(networks, name)
+		}
+	}
+	sp.Networks = networks
+	delete(sp.NativeIDs, network)
+	if statusid, published := rums.StatusIDs[network]; published {
+		if sp.StatusIDs == nil {
+			sp.StatusIDs = make(map[string]string, 1)
+		}
+		sp.StatusIDs[network] = statusid
+	}
+	if threadids, published := rums.ThreadStatusIDs[network]; published {
+		if sp.ThreadStatusIDs == nil {
+			sp.ThreadStatusIDs = make(map[string][]string, 1)
+		}
+		sp.ThreadStatusIDs[network] = threadids
+	}
+	ps.save()
+}
+
+/// forget sp and its images once it was published or failed to
+func (ps *PostScheduler) done(sp ScheduledPost) {
+	ps.lock.Lock()
+	delete(ps.posts, sp.EventID)
+	delete(ps.publishing, sp.EventID)
+	ps.save()
+	ps.lock.Unlock()
+	if sp.HasMedia {
+		ps.media.RemoveAll(sp.EventID)
+	}
+}
+
+/// schedule sp, moving the images the user queued along with it. Returns sp with its Number
+func (ps *PostScheduler) Add(sp ScheduledPost) ScheduledPost {
+	if sp.HasMedia {
+		if err := moveQueuedMedia(media_store_, sp.MatrixUser, ps.media, sp.EventID); err != nil {
+			log.Println("PostScheduler: could not keep images:", err)
+			sp.HasMedia = false
+		}
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.last_number++
+	sp.Number = ps.last_number
+	ps.posts[sp.EventID] = &sp
+	ps.save()
+	return sp
+}
+
+/// returns a copy of the pending post scheduled by matrix event eventid, unless we are publishing it already
+func (ps *PostScheduler) Get(eventid string) (ScheduledPost, bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if sp, inmap := ps.posts[eventid]; inmap && !ps.publishing[eventid] {
+		return *sp, true
+	}
+	return ScheduledPost{}, false
+}
+
+func (ps *PostScheduler) GetByNumber(number int) (ScheduledPost, bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for eventid, sp := range ps.posts {
+		if sp.Number == number && !ps.publishing[eventid] {
+			return *sp, true
+		}
+	}
+	return ScheduledPost{}, false
+}
+
+/// all pending posts, next one first
+func (ps *PostScheduler) List() []ScheduledPost {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	rv := make([]ScheduledPost, 0, len(ps.posts))
+	for eventid, sp := range ps.posts {
+		if !ps.publishing[eventid] {
+			rv = append(rv, *sp)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Due.Before(rv[j].Due) })
+	return rv
+}
+
+/// forget the post scheduled by matrix event eventid, also on networks that would publish it themselves
+func (ps *PostScheduler) Cancel(eventid string) error {
+	ps.lock.Lock()
+	sp, inmap := ps.posts[eventid]
+	publishing := ps.publishing[eventid]
+	if inmap && !publishing {
+		delete(ps.posts, eventid)
+		ps.save()
+	}
+	ps.lock.Unlock()
+	if !inmap {
+		return fmt.Errorf("no such scheduled post")
+	}
+	if publishing {
+		return fmt.Errorf("too late, it is being published right now")
+	}
+	var err error
+	for network, scheduledid := range sp.NativeIDs {
+		if scheduler, canschedule := getPublisher(network).(StatusScheduler); canschedule {
+			if cancelerr := scheduler.CancelScheduled(scheduledid); cancelerr != nil {
+				err = cancelerr
+			}
+		}
+	}
+	if sp.HasMedia {
+		ps.media.RemoveAll(eventid)
+	}
+	return err
+}
+
+/// copy the images of sp where Publishers look for images of sp.MediaNick(). We keep ours until done.
+func (ps *PostScheduler) restoreMedia(sp *ScheduledPost) error {
+	if !sp.HasMedia || media_store_ == nil {
+		return nil
+	}
+	media_store_.RemoveAll(sp.MediaNick()) // left over from a publish attempt before a restart
+	return copyQueuedMedia(ps.media, sp.EventID, media_store_, sp.MediaNick())
+}
+
+var schedule_location_ *time.Location = time.Local
+
+/// understands "90m", "2h30m", "15:04" (next time it's that time), "2006-01-02 15:04" and "2006-01-02T15:04".
+/// Returns the time and what follows it in args
+func parseScheduleTime(args string, now time.Time) (time.Time, string, error) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 3)
+	rest := func(numfields int) string {
+		return strings.TrimSpace(strings.Join(fields[numfields:], " "))
+	}
+	if len(fields) == 0 || len(fields[0]) == 0 {
+		return now, "", fmt.Errorf("when?")
+	}
+	if delay, err := time.ParseDuration(fields[0]); err == nil {
+		if delay <= 0 {
+			return now, "", fmt.Errorf("can't schedule into the past")
+		}
+		return now.Add(delay), rest(1), nil
+	}
+	if len(fields) > 1 {
+		if at, err := time.ParseInLocation("2006-01-02 15:04", fields[0]+" "+fields[1], schedule_location_); err == nil {
+			return at, rest(2), nil
+		}
+	}
+	if at, err := time.ParseInLocation("2006-01-02T15:04", fields[0], schedule_location_); err == nil {
+		return at, rest(1), nil
+	}
+	if clock, err := time.ParseInLocation("15:04", fields[0], schedule_location_); err == nil {
+		localnow := now.In(schedule_location_)
+		at := time.Date(localnow.Year(), localnow.Month(), localnow.Day(), clock.Hour(), clock.Minute(), 0, 0, schedule_location_)
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, rest(1), nil
+	}
+	return now, "", fmt.Errorf("don't know when %s is. Try e.g. 90m, 2h30m, 17:00 or 2006-01-02 17:00", fields[0])
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+/// Everything we remember across restarts lives as JSON in [state]dir. Without a state dir we simply forget.
+
+/// read filename from the state dir into v. Returns false if there is nothing (readable) to read.
+func loadStateFile(filename string, v interface{}) bool {
+	if len(state_dir_) == 0 {
+		return false
+	}
+	contents, err := ioutil.ReadFile(path.Join(state_dir_, filename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("loadStateFile %s: %s", filename, err)
+		}
+		return false
+	}
+	if err = json.Unmarshal(contents, v); err != nil {
+		log.Printf("loadStateFile %s: %s", filename, err)
+		return false
+	}
+	return true
+}
+
+/// write v to filename in the state dir, via tempfile and rename so we never leave a half written file behind
+func saveStateFile(filename string, v interface{}) {
+	if len(state_dir_) == 0 {
+		return
+	}
+	contents, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("saveStateFile %s: %s", filename, err)
+		return
+	}
+	statefilepath := path.Join(state_dir_, filename)
+	if err = ioutil.WriteFile(statefilepath+".tmp", contents, 0600); err != nil {
+		log.Printf("saveStateFile %s: %s", filename, err)
+		return
+	}
+	if err = os.Rename(statefilepath+".tmp", statefilepath); err != nil {
+		log.Printf("saveStateFile %s: %s", filename, err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
-import mastodon "github.com/mattn/go-mastodon"
+import (
+	"time"
+)
 
 type MsgStatusDataAction int
 
@@ -8,13 +10,39 @@ const (
 	actionPost   MsgStatusDataAction = iota
 	actionReblog MsgStatusDataAction = iota
 	actionFav    MsgStatusDataAction = iota
+	actionMirror MsgStatusDataAction = iota // status of someone else, written into the controlling room by us
 )
 
+const rums_state_filename_ string = "msgstatusmap.json"
+
 type MsgStatusData struct {
-	MatrixUser string
-	TootID     mastodon.ID
-	TweetID    int64
-	Action     MsgStatusDataAction
+	MatrixUser      string
+	StatusIDs       map[string]string   // network name -> status id
+	ThreadStatusIDs map[string][]string // network name -> further status ids, if the post was split into a thread
+	Action          MsgStatusDataAction
+	Visibility      string // of our own posts, empty for the accounts default
+	Stored          time.Time
+}
+
+/// the status to reply to or thread onto, i.e. the last one of a thread
+func (rums *MsgStatusData) LastStatusID(network string) string {
+	if threadids := rums.ThreadStatusIDs[network]; len(threadids) > 0 {
+		return threadids[len(threadids)-1]
+	}
+	return rums.StatusIDs[network]
+}
+
+/// all status ids of network, last one first
+func (rums *MsgStatusData) AllStatusIDsReversed(network string) []string {
+	threadids := rums.ThreadStatusIDs[network]
+	rv := make([]string, 0, len(threadids)+1)
+	for idx := len(threadids) - 1; idx >= 0; idx-- {
+		rv = append(rv, threadids[idx])
+	}
+	if statusid, inmap := rums.StatusIDs[network]; inmap && len(statusid) > 0 {
+		rv = append(rv, statusid)
+	}
+	return rv
 }
 
 type RUMSStoreMsg struct {
@@ -27,18 +55,69 @@ type RUMSRetrieveMsg struct {
 	future chan<- *MsgStatusData
 }
 
-func runRememberUsersMessageToStatus() (rv_store_chan chan<- RUMSStoreMsg, rv_retrieve_chan chan<- RUMSRetrieveMsg) {
+/// ask the brain about key, returns nil if we know nothing about it
+func retrieveRUMS(retrieve_chan chan<- RUMSRetrieveMsg, key string) *MsgStatusData {
+	future_chan := make(chan *MsgStatusData, 1)
+	retrieve_chan <- RUMSRetrieveMsg{key: key, future: future_chan}
+	return <-future_chan
+}
+
+/// forget everything older than the retention window, so the brain (and its file) stays bounded
+func pruneRUMSBrain(brain map[string]MsgStatusData) {
+	if rums_retention_ <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-rums_retention_)
+	for key, rums := range brain {
+		if rums.Stored.Before(cutoff) {
+			delete(brain, key)
+		}
+	}
+}
+
+func loadRUMSBrain(brain map[string]MsgStatusData) {
+	if loadStateFile(rums_state_filename_, &brain) {
+		pruneRUMSBrain(brain)
+	}
+}
+
+func saveRUMSBrain(brain map[string]MsgStatusData) {
+	saveStateFile(rums_state_filename_, brain)
+}
+
+/// preloaded data (e.g. rebuilt from room history) is merged into what we have on disk
+func runRememberUsersMessageToStatus(preload map[string]MsgStatusData) (rv_store_chan chan<- RUMSStoreMsg, rv_retrieve_chan chan<- RUMSRetrieveMsg) {
 	store_chan := make(chan RUMSStoreMsg, 20)
 	retrieve_chan := make(chan RUMSRetrieveMsg, 20)
 	go func() {
 		brain := make(map[string]MsgStatusData, 100)
+		loadRUMSBrain(brain)
+		if len(preload) > 0 {
+			for key, data := range preload {
+				if known, inmap := brain[key]; inmap && known.Action == data.Action {
+					for network, statusid := range known.StatusIDs {
+						if _, inmap := data.StatusIDs[network]; !inmap {
+							data.StatusIDs[network] = statusid
+						}
+					}
+				}
+				brain[key] = data
+			}
+			pruneRUMSBrain(brain)
+			saveRUMSBrain(brain)
+		}
 		for {
 			select {
 			case storeme, chanok := <-store_chan:
 				if !chanok {
 					return
 				}
+				if storeme.data.Stored.IsZero() {
+					storeme.data.Stored = time.Now()
+				}
 				brain[storeme.key] = storeme.data
+				pruneRUMSBrain(brain)
+				saveRUMSBrain(brain)
 			case retrieveme, chanok := <-retrieve_chan:
 				if !chanok {
 					return
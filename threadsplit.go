@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/// Splitting of posts that are too long for a network into a numbered thread.
+/// Each part gets thread_numbering_format_ appended, so we reserve room for that.
+
+const thread_numbering_format_ string = " (%d/%d)"
+
+/// chinese and japanese end sentences without a space after them
+const thread_fullwidth_sentence_ends_ string = "。！？"
+
+type characterCounter func(string) int
+
+/// split post into parts, each fitting into limit characters as counted by countfn, including numbering
+func splitIntoThread(post string, limit int, countfn characterCounter) []string {
+	post = strings.TrimSpace(post)
+	if countfn(post) <= limit {
+		return []string{post}
+	}
+	numparts := 2
+	for {
+		reserved := countfn(fmt.Sprintf(thread_numbering_format_, numparts, numparts))
+		if limit-reserved <= 0 {
+			return []string{post}
+		}
+		parts := splitAtBoundaries(post, limit-reserved, countfn)
+		if len(parts) <= numparts {
+			for idx := range parts {
+				parts[idx] += fmt.Sprintf(thread_numbering_format_, idx+1, len(parts))
+			}
+			return parts
+		}
+		numparts = len(parts) // more parts than we reserved digits for, try again
+	}
+}
+
+/// cut text into parts fitting limit, preferring the end of a sentence, then a line break or space
+/// and only cutting words apart if there is no other way
+func splitAtBoundaries(text string, limit int, countfn characterCounter) []string {
+	var parts []string
+	rest := []rune(strings.TrimSpace(text))
+	for len(rest) > 0 && countfn(string(rest)) > limit {
+		//longest prefix that still fits. Counting is not strictly monotonic (think links), so bisect and then make sure.
+		maxcut, upper := 1, len(rest)
+		for maxcut < upper {
+			mid := (maxcut + upper + 1) / 2
+			if countfn(string(rest[:mid])) <= limit {
+				maxcut = mid
+			} else {
+				upper = mid - 1
+			}
+		}
+		for maxcut > 1 && countfn(string(rest[:maxcut])) > limit {
+			maxcut--
+		}
+		cut := findThreadCut(rest[:maxcut], len(rest) > maxcut && unicode.IsSpace(rest[maxcut]))
+		parts = append(parts, strings.TrimSpace(string(rest[:cut])))
+		rest = []rune(strings.TrimSpace(string(rest[cut:])))
+	}
+	if len(rest) > 0 {
+		parts = append(parts, string(rest))
+	}
+	return parts
+}
+
+/// returns the position within candidate at which we should cut.
+/// Don't go back further than half the candidate for a sentence end or a third for a space, short parts look silly.
+func findThreadCut(candidate []rune, followed_by_space bool) int {
+	if idx := len(candidate) - 1; idx >= 0 && (strings.ContainsRune(thread_fullwidth_sentence_ends_, candidate[idx]) || (followed_by_space && strings.ContainsRune(".!?…", candidate[idx]))) {
+		return len(candidate)
+	}
+	for idx := len(candidate) - 1; idx > len(candidate)/2; idx-- {
+		if candidate[idx] == '\n' || (unicode.IsSpace(candidate[idx]) && strings.ContainsRune(".!?…", candidate[idx-1])) || strings.ContainsRune(thread_fullwidth_sentence_ends_, candidate[idx-1]) {
+			return idx
+		}
+	}
+	if followed_by_space {
+		return len(candidate)
+	}
+	for idx := len(candidate) - 1; idx > len(candidate)/3; idx-- {
+		if unicode.IsSpace(candidate[idx]) {
+			return idx
+		}
+	}
+	return len(candidate)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+/// the parts of a thread without their numbering, joined again
+func joinThread(parts []string) string {
+	texts := make([]string, len(parts))
+	for idx, part := range parts {
+		texts[idx] = strings.TrimSuffix(part, fmt.Sprintf(thread_numbering_format_, idx+1, len(parts)))
+	}
+	return strings.Join(texts, " ")
+}
+
+func withoutSpace(text string) string {
+	return strings.Join(strings.Fields(text), "")
+}
+
+func TestSplitIntoThread(t *testing.T) {
+	runecount := utf8.RuneCountInString
+	sentences := "This is the first sentence. Here comes the second one! And a third one to finish?"
+	words := strings.Repeat("lorem ipsum dolor sit amet ", 40)
+	tests := []struct {
+		name     string
+		post     string
+		limit    int
+		countfn  characterCounter
+		numparts int // 0 to not check
+	}{
+		{"fits", "short enough", 20, runecount, 1},
+		{"fits exactly", strings.Repeat("x", 20), 20, runecount, 1},
+		{"sentences", sentences, 70, runecount, 2},
+		{"words", words, 100, runecount, 0},
+		{"more than nine parts", words, 30, runecount, 0},
+		{"one long word", strings.Repeat("x", 95), 30, runecount, 4},
+		{"line breaks", "first line\nsecond line\nthird line\nfourth line", 30, runecount, 0},
+		{"cjk on twitter", strings.Repeat("日本語のテキスト。", 30), 280, countCharactersTwitter, 0},
+		{"links on twitter", strings.Repeat("read https://example.com/a/very/long/path/to/an/article ", 20), 100, countCharactersTwitter, 0},
+	}
+	for _, test := range tests {
+		parts := splitIntoThread(test.post, test.limit, test.countfn)
+		if test.numparts > 0 && len(parts) != test.numparts {
+			t.Errorf("%s: %d parts, want %d: %q", test.name, len(parts), test.numparts, parts)
+		}
+		for idx, part := range parts {
+			if count := test.countfn(part); count > test.limit {
+				t.Errorf("%s: part %d counts %d, limit is %d: %q", test.name, idx+1, count, test.limit, part)
+			}
+			if len(parts) > 1 && !strings.HasSuffix(part, fmt.Sprintf(thread_numbering_format_, idx+1, len(parts))) {
+				t.Errorf("%s: part %d is not numbered %d/%d: %q", test.name, idx+1, idx+1, len(parts), part)
+			}
+			if len(parts) == 1 && part != strings.TrimSpace(test.post) {
+				t.Errorf("%s: single part changed: %q", test.name, part)
+			}
+		}
+		/// nothing lost or added, except whitespace where we cut
+		if withoutSpace(joinThread(parts)) != withoutSpace(test.post) {
+			t.Errorf("%s: text changed: %q", test.name, parts)
+		}
+	}
+}
+
+func TestSplitIntoThreadBoundaries(t *testing.T) {
+	runecount := utf8.RuneCountInString
+	parts := splitIntoThread("This is the first sentence. Here comes the second one! And a third one to finish?", 70, runecount)
+	if len(parts) != 2 || parts[0] != "This is the first sentence. Here comes the second one! (1/2)" {
+		t.Errorf("did not cut at a sentence end: %q", parts)
+	}
+	parts = splitIntoThread(strings.Repeat("日本語のテキスト。", 30), 280, countCharactersTwitter)
+	for idx, part := range parts {
+		if !strings.HasSuffix(part, "。"+fmt.Sprintf(thread_numbering_format_, idx+1, len(parts))) {
+			t.Errorf("part %d does not end with a sentence: %q", idx+1, part)
+		}
+	}
+	parts = splitIntoThread(strings.Repeat("lorem ipsum dolor sit amet ", 40), 100, runecount)
+	for idx, part := range parts {
+		for _, word := range strings.Fields(strings.TrimSuffix(part, fmt.Sprintf(thread_numbering_format_, idx+1, len(parts)))) {
+			if !strings.Contains("lorem ipsum dolor sit amet", word) {
+				t.Errorf("part %d cut a word apart: %q", idx+1, part)
+			}
+		}
+	}
+	parts = splitIntoThread(strings.Repeat("read https://example.com/a/very/long/path/to/an/article ", 20), 100, countCharactersTwitter)
+	for idx, part := range parts {
+		if strings.Count(part, "https://") != strings.Count(part, "article") {
+			t.Errorf("part %d cut a link apart: %q", idx+1, part)
+		}
+	}
+	/// two digit numbering needs more room, every part must still fit
+	parts = splitIntoThread(strings.Repeat("lorem ipsum dolor sit amet ", 40), 30, runecount)
+	if len(parts) < 10 {
+		t.Errorf("expected at least 10 parts, got %d", len(parts))
+	}
+	if last := parts[len(parts)-1]; !strings.HasSuffix(last, fmt.Sprintf(" (%d/%d)", len(parts), len(parts))) {
+		t.Errorf("last part is numbered wrong: %q", last)
+	}
+	/// no room for even the numbering, better one part too long than an endless loop
+	if parts = splitIntoThread("far too long for this", 5, runecount); len(parts) != 1 {
+		t.Errorf("limit below the numbering: %q", parts)
+	}
+}
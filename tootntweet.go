@@ -3,9 +3,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ChimeraCoder/anaconda"
 	mastodon "github.com/mattn/go-mastodon"
@@ -14,26 +17,63 @@ import (
 const character_limit_twitter_ int = 280
 const character_limit_mastodon_ int = 500
 const imgbytes_limit_twitter_ int64 = 5242880
+const gifbytes_limit_twitter_ int64 = 15 * 1024 * 1024
+const videobytes_limit_twitter_ int64 = 512 * 1024 * 1024
+const videoduration_limit_twitter_ time.Duration = 140 * time.Second
+const videobytes_limit_mastodon_ int64 = 40 * 1024 * 1024
 const imgbytes_limit_mastodon_ int64 = 4 * 1024 * 1024
+const imgside_limit_twitter_ int = 8192
+const imgpixels_limit_mastodon_ int64 = 4096 * 4096
+const imgcount_limit_twitter_ int = 4
+const imgcount_limit_mastodon_ int = 4
+
+const poll_max_options_mastodon_ int = 4
+const poll_max_chars_per_option_mastodon_ int = 50
+const poll_min_expiration_mastodon_ time.Duration = 5 * time.Minute
+const poll_max_expiration_mastodon_ time.Duration = 2629746 * time.Second
+const mastodon_schedule_min_lead_ time.Duration = 6 * time.Minute
 
 const webbaseformaturl_twitter_ string = "https://twitter.com/statuses/%s"
 
-func checkCharacterLimit(status string) error {
-	// get minimum character limit
-	climit := 10000
-	if c["server"]["mastodon"] == "true" && climit > character_limit_mastodon_ {
-		climit = character_limit_mastodon_
+func checkCharacterLimit(status string, opts PostOptions, publishers []Publisher) error {
+	// each network counts differently, so check each and tell the user about all of them
+	exceeds := false
+	counts := make([]string, 0, len(publishers))
+	for _, p := range publishers {
+		if p.Accepts(opts) != nil {
+			continue
+		}
+		text, reserved := p.PrepareText(status, opts)
+		count := p.CountCharacters(text) + reserved
+		if count > p.CharacterLimit() {
+			exceeds = true
+		}
+		counts = append(counts, fmt.Sprintf("%d/%d on %s", count, p.CharacterLimit(), p.Name()))
 	}
-	if c["server"]["twitter"] == "true" && climit > character_limit_twitter_ {
-		climit = character_limit_twitter_
+	if exceeds {
+		return fmt.Errorf("status/tweet exceeds character limit: %s", strings.Join(counts, ", "))
 	}
+	return nil
+}
 
-	// get number of characters ... this is not entirely accurate, but close enough. (read twitters API page on character counting)
-	if len(status) <= climit {
-		return nil
-	} else {
-		return fmt.Errorf("status/tweet of %d characters exceeds limit of %d", len(status), climit)
+/// like checkCharacterLimit, but if we split long posts into threads, only checks the thread does not get too long
+func checkPostLength(status string, opts PostOptions, publishers []Publisher) error {
+	if !split_into_thread_ {
+		return checkCharacterLimit(status, opts, publishers)
 	}
+	for _, p := range publishers {
+		if p.Accepts(opts) != nil {
+			continue
+		}
+		text, reserved := p.PrepareText(status, opts)
+		if p.CharacterLimit()-reserved <= 0 {
+			return fmt.Errorf("content warning too long for %s", p.Name())
+		}
+		if numparts := len(splitIntoThread(text, p.CharacterLimit()-reserved, p.CountCharacters)); numparts > thread_max_parts_ {
+			return fmt.Errorf("status/tweet would need a thread of %d parts on %s, limit is %d", numparts, p.Name(), thread_max_parts_)
+		}
+	}
+	return nil
 }
 
 /////////////
@@ -48,11 +88,158 @@ func initTwitterClient() *anaconda.TwitterApi {
 		c["twitter"]["consumer_secret"])
 }
 
-func sendTweet(client *anaconda.TwitterApi, post, matrixnick string) (weburl string, statusid int64, err error) {
+type TwitterPublisher struct {
+	client *anaconda.TwitterApi
+}
+
+func newTwitterPublisher(client *anaconda.TwitterApi) *TwitterPublisher {
+	return &TwitterPublisher{client: client}
+}
+
+func (tp *TwitterPublisher) Name() string                 { return twitter_net }
+func (tp *TwitterPublisher) StatusNoun() string           { return "tweet" }
+func (tp *TwitterPublisher) CharacterLimit() int          { return character_limit_twitter_ }
+func (tp *TwitterPublisher) ImageCountLimit() int         { return imgcount_limit_twitter_ }
+func (tp *TwitterPublisher) CountCharacters(s string) int { return countCharactersTwitter(s) }
+
+/// twitter takes images and videos, but no audio
+func (tp *TwitterPublisher) SupportsMediaType(mimetype string) bool {
+	return isImageMediaType(mimetype) || isVideoMediaType(mimetype)
+}
+
+func (tp *TwitterPublisher) MediaBytesLimit(mimetype string) int64 {
+	switch {
+	case mimetype == "image/gif":
+		return gifbytes_limit_twitter_
+	case isVideoMediaType(mimetype):
+		return videobytes_limit_twitter_
+	}
+	return imgbytes_limit_twitter_
+}
+
+func (tp *TwitterPublisher) ImageDimensionLimit() (int, int64) { return imgside_limit_twitter_, 0 }
+
+func (tp *TwitterPublisher) MediaDurationLimit(mimetype string) time.Duration {
+	if isVideoMediaType(mimetype) {
+		return videoduration_limit_twitter_
+	}
+	return 0
+}
+
+/// twitter has no content warnings, [twitter]cw_fallback decides what we do instead:
+/// "prefix" the text with the content warning, mark media "possibly_sensitive", "skip" the tweet or "ignore" the content warning
+/// tweets are always public, so followers-only and direct posts are not for twitter
+/// and the twitter API we use can't create polls
+func (tp *TwitterPublisher) Accepts(opts PostOptions) error {
+	if opts.Poll != nil {
+		return fmt.Errorf("we can't create polls on twitter")
+	}
+	if visibility := opts.visibilityFor(""); isRestrictedVisibility(visibility) {
+		return fmt.Errorf("tweets can't be %s", visibility)
+	}
+	if len(opts.SpoilerText) > 0 && c.GetValueDefault("twitter", "cw_fallback", "prefix") == "skip" {
+		return fmt.Errorf("twitter has no content warnings")
+	}
+	return nil
+}
+
+func (tp *TwitterPublisher) PrepareText(post string, opts PostOptions) (string, int) {
+	if len(opts.SpoilerText) > 0 && c.GetValueDefault("twitter", "cw_fallback", "prefix") == "prefix" {
+		return fmt.Sprintf("CW: %s\n\n%s", opts.SpoilerText, post), 0
+	}
+	return post, 0
+}
+
+func (tp *TwitterPublisher) Post(post, matrixnick string, opts PostOptions) (string, string, error) {
+	weburl, statusid, err := sendTweet(tp.client, post, matrixnick, opts)
+	if err != nil {
+		return "", "", err
+	}
+	return weburl, strconv.FormatInt(statusid, 10), nil
+}
+
+/// twitter can't edit, so we repost. The repost should answer the same tweet and must not lose media.
+/// Twitter adds the mentions of a reply itself.
+func (tp *TwitterPublisher) RepostContext(statusid string) (RepostInfo, error) {
+	postid, err := parseTweetID(statusid)
+	if err != nil {
+		return RepostInfo{}, err
+	}
+	tweet, err := tp.client.GetTweet(postid, url.Values{})
+	if err != nil {
+		return RepostInfo{}, err
+	}
+	return RepostInfo{InReplyTo: tweet.InReplyToStatusIdStr, HasMedia: len(tweet.Entities.Media) > 0 || len(tweet.ExtendedEntities.Media) > 0}, nil
+}
+
+func parseTweetID(statusid string) (int64, error) {
+	postid, err := strconv.ParseInt(statusid, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if postid <= 0 {
+		return 0, fmt.Errorf("Sorry could not parse status id")
+	}
+	return postid, nil
+}
+
+func (tp *TwitterPublisher) Delete(statusid string) error {
+	postid, err := parseTweetID(statusid)
+	if err == nil {
+		_, err = tp.client.DeleteTweet(postid, true)
+	}
+	return err
+}
+
+func (tp *TwitterPublisher) Reblog(statusid string) error {
+	postid, err := parseTweetID(statusid)
+	if err == nil {
+		_, err = tp.client.Retweet(postid, true)
+	}
+	return err
+}
+
+func (tp *TwitterPublisher) Unreblog(statusid string) error {
+	postid, err := parseTweetID(statusid)
+	if err == nil {
+		_, err = tp.client.UnRetweet(postid, true)
+	}
+	return err
+}
+
+func (tp *TwitterPublisher) Favourite(statusid string) error {
+	postid, err := parseTweetID(statusid)
+	if err == nil {
+		_, err = tp.client.Favorite(postid)
+	}
+	return err
+}
+
+func (tp *TwitterPublisher) Unfavourite(statusid string) error {
+	postid, err := parseTweetID(statusid)
+	if err == nil {
+		_, err = tp.client.Unfavorite(postid)
+	}
+	return err
+}
+
+func sendTweet(client *anaconda.TwitterApi, post, matrixnick string, opts PostOptions) (weburl string, statusid int64, err error) {
 	v := url.Values{}
 	v.Set("status", post)
-	if c.GetValueDefault("images", "enabled", "false") == "true" {
-		if media_ids, _ := getImagesForTweet(client, matrixnick); media_ids != nil {
+	if opts.Sensitive || (len(opts.SpoilerText) > 0 && c.GetValueDefault("twitter", "cw_fallback", "prefix") == "possibly_sensitive") {
+		v.Set("possibly_sensitive", "true")
+	}
+	if len(opts.InReplyTo) > 0 {
+		v.Set("in_reply_to_status_id", opts.InReplyTo)
+		v.Set("auto_populate_reply_metadata", "true")
+	}
+	/// if the media fails to upload, so does the tweet. The media stays queued for another try
+	if c.GetValueDefault("images", "enabled", "false") == "true" && len(matrixnick) > 0 {
+		var media_ids []string
+		if media_ids, err = getMediaForTweet(matrixnick); err != nil {
+			return
+		}
+		if media_ids != nil {
 			v.Set("media_ids", strings.Join(media_ids, ","))
 		}
 	}
@@ -66,26 +253,41 @@ func sendTweet(client *anaconda.TwitterApi, post, matrixnick string) (weburl str
 	return
 }
 
-func getImagesForTweet(client *anaconda.TwitterApi, nick string) ([]string, error) {
-	imagepaths, err := getUserFileList(nick)
+/// everything goes up in chunks, straight from media_store_. Audio is left out, twitter does not take it.
+/// Descriptions are added afterwards, if they fail the tweet still goes out. Returns nil if nothing is queued.
+func getMediaForTweet(nick string) ([]string, error) {
+	queued, err := getQueuedMedia(nick)
 	if err != nil {
 		return nil, err
 	}
-	if len(imagepaths) == 0 {
-		return nil, fmt.Errorf("No stored image for nick")
+	if len(queued) == 0 {
+		return nil, nil
 	}
-	media_ids := make([]string, len(imagepaths))
-	for idx, imagepath := range imagepaths {
-		if b64data, err := readFileIntoBase64(imagepath); err != nil {
+	media_ids := make([]string, 0, len(queued))
+	for _, media := range queued {
+		category := "tweet_image"
+		switch {
+		case isVideoMediaType(media.MimeType):
+			category = "tweet_video"
+		case media.MimeType == "image/gif":
+			category = "tweet_gif"
+		case !isImageMediaType(media.MimeType):
+			continue
+		}
+		contents, err := media_store_.Open(nick, media.ID)
+		if err != nil {
 			return nil, err
-		} else {
-			if tmedia, err := client.UploadMedia(b64data); err != nil {
-				return nil, err
-			} else {
-				media_ids[idx] = strconv.FormatInt(tmedia.MediaID, 10)
-			}
 		}
-
+		mediaid, err := twitterUploadMediaChunked(contents, media.Size, media.MimeType, category)
+		contents.Close()
+		if err != nil {
+			return nil, err
+		}
+		media_ids = append(media_ids, mediaid)
+		twitterSetAltTextOrLog(mediaid, media.AltText)
+	}
+	if len(media_ids) == 0 {
+		return nil, nil
 	}
 	return media_ids, nil
 }
@@ -103,17 +305,292 @@ func initMastodonClient() *mastodon.Client {
 	})
 }
 
-func sendToot(client *mastodon.Client, post, matrixnick string) (weburl string, statusid mastodon.ID, err error) {
-	var mids []mastodon.ID
-	usertoot := &mastodon.Toot{Status: post}
-	if c.GetValueDefault("images", "enabled", "false") == "true" {
-		if mids, err = getImagesForToot(client, matrixnick); err == nil && mids != nil {
-			usertoot.MediaIDs = mids
+type MastodonPublisher struct {
+	client      *mastodon.Client
+	limits      MastodonInstanceLimits
+	limits_lock sync.RWMutex
+}
+
+func newMastodonPublisher(client *mastodon.Client) *MastodonPublisher {
+	mp := &MastodonPublisher{client: client, limits: MastodonInstanceLimits{
+		MaxCharacters:            character_limit_mastodon_,
+		MaxMediaAttachments:      imgcount_limit_mastodon_,
+		CharactersReservedPerURL: url_character_count_,
+		ImageSizeLimit:           imgbytes_limit_mastodon_,
+		ImagePixelLimit:          imgpixels_limit_mastodon_,
+		VideoSizeLimit:           videobytes_limit_mastodon_,
+		PollMaxOptions:           poll_max_options_mastodon_,
+		PollMaxCharsPerOption:    poll_max_chars_per_option_mastodon_,
+		PollMinExpiration:        poll_min_expiration_mastodon_,
+		PollMaxExpiration:        poll_max_expiration_mastodon_,
+	}}
+	mp.taskRefreshInstanceLimits()
+	return mp
+}
+
+/// ask the instance about its limits now and then every [mastodon]refresh_instance_limits_hours
+func (mp *MastodonPublisher) taskRefreshInstanceLimits() {
+	refresh := func() {
+		limits, err := mastodonGetInstanceLimits(context.Background(), mp.client, mp.getLimits())
+		if err != nil {
+			log.Println("MastodonPublisher: could not get instance limits:", err)
+			return
+		}
+		mp.limits_lock.Lock()
+		mp.limits = limits
+		mp.limits_lock.Unlock()
+	}
+	refresh()
+	hours, err := strconv.Atoi(c.GetValueDefault("mastodon", "refresh_instance_limits_hours", "12"))
+	if err != nil || hours <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(hours) * time.Hour) {
+			refresh()
 		}
+	}()
+}
+
+func (mp *MastodonPublisher) getLimits() MastodonInstanceLimits {
+	mp.limits_lock.RLock()
+	defer mp.limits_lock.RUnlock()
+	return mp.limits
+}
+
+func (mp *MastodonPublisher) Name() string         { return mastodon_net }
+func (mp *MastodonPublisher) StatusNoun() string   { return "toot" }
+func (mp *MastodonPublisher) CharacterLimit() int  { return mp.getLimits().MaxCharacters }
+func (mp *MastodonPublisher) ImageCountLimit() int { return mp.getLimits().MaxMediaAttachments }
+func (mp *MastodonPublisher) CountCharacters(s string) int {
+	return countCharactersMastodon(s, mp.getLimits().CharactersReservedPerURL)
+}
+
+/// what the instance says it supports, or images, video and audio if it doesn't tell
+func (mp *MastodonPublisher) SupportsMediaType(mimetype string) bool {
+	supported := mp.getLimits().SupportedMimeTypes
+	if len(supported) == 0 {
+		return isImageMediaType(mimetype) || isVideoMediaType(mimetype) || isAudioMediaType(mimetype)
+	}
+	for _, supportedtype := range supported {
+		if supportedtype == mimetype {
+			return true
+		}
+	}
+	return false
+}
+
+/// mastodon uses the video limit for audio as well
+func (mp *MastodonPublisher) MediaBytesLimit(mimetype string) int64 {
+	if isImageMediaType(mimetype) {
+		return mp.getLimits().ImageSizeLimit
+	}
+	return mp.getLimits().VideoSizeLimit
+}
+
+func (mp *MastodonPublisher) MediaDurationLimit(mimetype string) time.Duration { return 0 }
+
+/// mastodon scales larger images down itself, but refuses them above the limit
+func (mp *MastodonPublisher) ImageDimensionLimit() (int, int64) {
+	return 0, mp.getLimits().ImagePixelLimit
+}
+
+func (mp *MastodonPublisher) Accepts(opts PostOptions) error {
+	if opts.Poll == nil {
+		return nil
+	}
+	limits := mp.getLimits()
+	if len(opts.Poll.Options) < 2 || len(opts.Poll.Options) > limits.PollMaxOptions {
+		return fmt.Errorf("polls need 2 to %d options", limits.PollMaxOptions)
+	}
+	for _, option := range opts.Poll.Options {
+		if count := len([]rune(option)); count > limits.PollMaxCharsPerOption {
+			return fmt.Errorf("poll option '%s' is longer than %d characters", option, limits.PollMaxCharsPerOption)
+		}
+	}
+	if opts.Poll.ExpiresIn < limits.PollMinExpiration || opts.Poll.ExpiresIn > limits.PollMaxExpiration {
+		return fmt.Errorf("polls must run between %s and %s", limits.PollMinExpiration, limits.PollMaxExpiration)
+	}
+	return nil
+}
+
+/// the content warning counts towards the character limit, and so do the mentions newToot puts in front of a reply
+func (mp *MastodonPublisher) PrepareText(post string, opts PostOptions) (string, int) {
+	reserved := 0
+	if len(opts.SpoilerText) > 0 {
+		reserved += mp.CountCharacters(opts.SpoilerText)
+	}
+	if len(opts.InReplyTo) > 0 && opts.ReplyToMirrored {
+		/// on error newToot fails the same way, no need to reserve anything
+		if mentions, _, err := getMastodonReplyContext(mp.client, mastodon.ID(opts.InReplyTo), true); err == nil && len(mentions) > 0 {
+			reserved += mp.CountCharacters(strings.Join(mentions, " ") + " ")
+		}
+	}
+	return post, reserved
+}
+
+func (mp *MastodonPublisher) Post(post, matrixnick string, opts PostOptions) (string, string, error) {
+	weburl, statusid, err := sendToot(mp, post, matrixnick, opts)
+	return weburl, string(statusid), err
+}
+
+func (mp *MastodonPublisher) Edit(statusid, post string, opts PostOptions) (string, error) {
+	ctx := context.Background()
+	oldstatus, err := mp.client.GetStatus(ctx, mastodon.ID(statusid))
+	if err != nil {
+		return "", err
+	}
+	if post, err = mp.keepReplyMentions(ctx, oldstatus, post, opts); err != nil {
+		return "", err
+	}
+	mstatus, err := mastodonEditStatus(ctx, mp.client, oldstatus, post, opts)
+	/// the status is there, so the edit endpoint is not. Mastodon before 3.5 and some Pleroma and Akkoma versions don't have it
+	if isMastodonEndpointMissing(err) {
+		return "", err_edit_not_supported_
+	}
+	if err != nil {
+		return "", err
+	}
+	return mstatus.URL, nil
+}
+
+/// for servers that can't edit
+func (mp *MastodonPublisher) RepostContext(statusid string) (RepostInfo, error) {
+	ctx := context.Background()
+	oldstatus, err := mp.client.GetStatus(ctx, mastodon.ID(statusid))
+	if err != nil {
+		return RepostInfo{}, err
+	}
+	prefix, err := mp.replyMentionsPrefix(ctx, oldstatus)
+	if err != nil {
+		return RepostInfo{}, err
+	}
+	parentid, _ := oldstatus.InReplyToID.(string)
+	return RepostInfo{InReplyTo: parentid, ReplyToMirrored: len(prefix) > 0, HasMedia: len(oldstatus.MediaAttachments) > 0}, nil
+}
+
+/// the mentions newToot put in front of oldstatus, if it replies to someone elses status, else ""
+func (mp *MastodonPublisher) replyMentionsPrefix(ctx context.Context, oldstatus *mastodon.Status) (string, error) {
+	parentid, isreply := oldstatus.InReplyToID.(string)
+	if !isreply || len(parentid) == 0 {
+		return "", nil
+	}
+	mentions, _, err := getMastodonReplyContext(mp.client, mastodon.ID(parentid), true)
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.Join(mentions, " ")
+	if len(mentions) == 0 || !strings.HasPrefix(normalizeStatusText(mastodonStatusSourceText(ctx, mp.client, oldstatus)), prefix) {
+		return "", nil
+	}
+	return prefix, nil
+}
+
+/// newToot put the participants of someone elses status in front of our reply to it. The edited text of the reply needs them too.
+func (mp *MastodonPublisher) keepReplyMentions(ctx context.Context, oldstatus *mastodon.Status, post string, opts PostOptions) (string, error) {
+	prefix, err := mp.replyMentionsPrefix(ctx, oldstatus)
+	if err != nil {
+		return "", err
+	}
+	if len(prefix) == 0 || strings.HasPrefix(post, prefix) {
+		return post, nil
+	}
+	post = prefix + " " + post
+	if limit := mp.CharacterLimit() - mp.CountCharacters(opts.SpoilerText); mp.CountCharacters(post) > limit {
+		return "", fmt.Errorf("with the mentions of the reply the toot would be %d characters long, limit is %d", mp.CountCharacters(post), limit)
+	}
+	return post, nil
+}
+
+func (mp *MastodonPublisher) Schedule(post, matrixnick string, opts PostOptions, at time.Time) (string, error) {
+	if at.Before(time.Now().Add(mastodon_schedule_min_lead_)) {
+		return "", fmt.Errorf("mastodon only schedules toots at least %s ahead", mastodon_schedule_min_lead_)
+	}
+	usertoot, err := newToot(mp, post, matrixnick, opts)
+	if err != nil {
+		return "", err
+	}
+	scheduledid, err := mastodonScheduleStatus(context.Background(), mp.client, usertoot, opts, at)
+	return string(scheduledid), err
+}
+
+func (mp *MastodonPublisher) CancelScheduled(scheduledid string) error {
+	return mastodonCancelScheduledStatus(context.Background(), mp.client, mastodon.ID(scheduledid))
+}
+
+func (mp *MastodonPublisher) FindScheduledStatus(scheduledid string, at time.Time, opts PostOptions) (string, error) {
+	statusid, err := mastodonFindPublishedScheduledStatus(context.Background(), mp.client, mastodon.ID(scheduledid), at)
+	return string(statusid), err
+}
+
+func (mp *MastodonPublisher) Delete(statusid string) error {
+	return mp.client.DeleteStatus(context.Background(), mastodon.ID(statusid))
+}
+
+func (mp *MastodonPublisher) Reblog(statusid string) error {
+	_, err := mp.client.Reblog(context.Background(), mastodon.ID(statusid))
+	return err
+}
+
+func (mp *MastodonPublisher) Unreblog(statusid string) error {
+	_, err := mp.client.Unreblog(context.Background(), mastodon.ID(statusid))
+	return err
+}
+
+func (mp *MastodonPublisher) Favourite(statusid string) error {
+	_, err := mp.client.Favourite(context.Background(), mastodon.ID(statusid))
+	return err
+}
+
+func (mp *MastodonPublisher) Unfavourite(statusid string) error {
+	_, err := mp.client.Unfavourite(context.Background(), mastodon.ID(statusid))
+	return err
+}
+
+/// the toot we send for post, with images queued by matrixnick attached
+func newToot(mp *MastodonPublisher, post, matrixnick string, opts PostOptions) (*mastodon.Toot, error) {
+	usertoot := &mastodon.Toot{
+		Status:      post,
+		InReplyToID: mastodon.ID(opts.InReplyTo),
+		Visibility:  opts.visibilityFor(""),
+		SpoilerText: opts.SpoilerText,
+		Sensitive:   opts.Sensitive,
+	}
+	if len(opts.InReplyTo) > 0 && (opts.ReplyToMirrored || len(opts.Visibility) == 0) {
+		mentions, visibility, err := getMastodonReplyContext(mp.client, mastodon.ID(opts.InReplyTo), opts.ReplyToMirrored)
+		if err != nil {
+			return nil, err
+		}
+		if len(mentions) > 0 {
+			usertoot.Status = strings.Join(mentions, " ") + " " + post
+		}
+		usertoot.Visibility = opts.visibilityFor(visibility)
+	}
+	// toots can have images or a poll, but not both. Images stay queued for the next post.
+	// If the media fails to upload or to process, so does the toot and the media stays queued for another try.
+	if c.GetValueDefault("images", "enabled", "false") == "true" && len(matrixnick) > 0 && opts.Poll == nil {
+		mids, err := getMediaForToot(mp, matrixnick)
+		if err != nil {
+			return nil, err
+		}
+		usertoot.MediaIDs = mids
+	}
+	return usertoot, nil
+}
+
+func sendToot(mp *MastodonPublisher, post, matrixnick string, opts PostOptions) (weburl string, statusid mastodon.ID, err error) {
+	client := mp.client
+	var usertoot *mastodon.Toot
+	if usertoot, err = newToot(mp, post, matrixnick, opts); err != nil {
+		return
 	}
 	// log.Println("sendToot", usertoot)
 	var mstatus *mastodon.Status
-	mstatus, err = client.PostStatus(context.Background(), usertoot)
+	if len(opts.Language) > 0 || opts.Poll != nil {
+		mstatus, err = mastodonPostStatus(context.Background(), client, usertoot, opts)
+	} else {
+		mstatus, err = client.PostStatus(context.Background(), usertoot)
+	}
 	if mstatus != nil && err == nil {
 		weburl = mstatus.URL
 		statusid = mstatus.ID
@@ -121,21 +598,64 @@ func sendToot(client *mastodon.Client, post, matrixnick string) (weburl string,
 	return
 }
 
-func getImagesForToot(client *mastodon.Client, matrixnick string) ([]mastodon.ID, error) {
-	imagepaths, err := getUserFileList(matrixnick)
+/// like any mastodon client, keep the visibility of the status we reply to
+/// and if wanted mention its author and everyone mentioned in it (except us)
+func getMastodonReplyContext(client *mastodon.Client, statusid mastodon.ID, wantmentions bool) (mentions []string, visibility string, err error) {
+	parent, err := client.GetStatus(context.Background(), statusid)
+	if err != nil {
+		return nil, "", err
+	}
+	if !wantmentions {
+		return nil, parent.Visibility, nil
+	}
+	my_account, err := client.GetAccountCurrentUser(context.Background())
+	if err != nil {
+		return nil, "", err
+	}
+	already_mentioned := make(map[string]bool, len(parent.Mentions)+1)
+	addmention := func(id mastodon.ID, acct string) {
+		if id == my_account.ID || already_mentioned[acct] {
+			return
+		}
+		already_mentioned[acct] = true
+		mentions = append(mentions, "@"+acct)
+	}
+	addmention(parent.Account.ID, parent.Account.Acct)
+	for _, mention := range parent.Mentions {
+		addmention(mention.ID, mention.Acct)
+	}
+	return mentions, parent.Visibility, nil
+}
+
+/// upload what matrixnick queued, leaving out what the instance does not take, like twitter leaves out audio.
+/// Returns nil if nothing is queued.
+func getMediaForToot(mp *MastodonPublisher, matrixnick string) ([]mastodon.ID, error) {
+	queued, err := getQueuedMedia(matrixnick)
 	if err != nil {
 		return nil, err
 	}
-	if len(imagepaths) == 0 {
-		return nil, fmt.Errorf("No stored image for nick")
+	if len(queued) == 0 {
+		return nil, nil
 	}
-	mastodon_ids := make([]mastodon.ID, len(imagepaths))
-	for idx, imagepath := range imagepaths {
-		if attachment, err := client.UploadMedia(context.Background(), imagepath); err != nil {
+	mastodon_ids := make([]mastodon.ID, 0, len(queued))
+	for _, media := range queued {
+		if !mp.SupportsMediaType(media.MimeType) {
+			log.Printf("getMediaForToot: %s does not take %s, leaving it out", mp.Name(), media.MimeType)
+			continue
+		}
+		contents, err := media_store_.Open(matrixnick, media.ID)
+		if err != nil {
 			return nil, err
-		} else {
-			mastodon_ids[idx] = attachment.ID
 		}
+		attachment, err := mastodonUploadMedia(context.Background(), mp.client, contents, media.FileName(), media.MimeType, media.AltText)
+		contents.Close()
+		if err != nil {
+			return nil, err
+		}
+		mastodon_ids = append(mastodon_ids, attachment.ID)
+	}
+	if len(mastodon_ids) == 0 {
+		return nil, nil
 	}
 	return mastodon_ids, nil
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/go-oauth/oauth"
+)
+
+/// anaconda's chunked upload can't set a media_category and can't ask for the processing state,
+/// without either twitter won't take longer videos. So we do it ourselves with the same credentials.
+
+const twitter_upload_url_ string = "https://upload.twitter.com/1.1/media/upload.json"
+const twitter_metadata_url_ string = "https://upload.twitter.com/1.1/media/metadata/create.json"
+const twitter_alt_text_max_chars_ int = 1000
+const twitter_upload_chunk_size_ int = 1024 * 1024
+const twitter_media_processing_max_wait_ time.Duration = 10 * time.Minute
+
+type twitterProcessingInfo struct {
+	State          string `json:"state"` // pending, in_progress, failed or succeeded
+	CheckAfterSecs int    `json:"check_after_secs"`
+	Error          *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type twitterUploadResponse struct {
+	MediaIDString  string                 `json:"media_id_string"`
+	ProcessingInfo *twitterProcessingInfo `json:"processing_info"`
+}
+
+func twitterOAuth() (*oauth.Client, *oauth.Credentials) {
+	return &oauth.Client{Credentials: oauth.Credentials{Token: c["twitter"]["consumer_key"], Secret: c["twitter"]["consumer_secret"]}},
+		&oauth.Credentials{Token: c["twitter"]["access_token"], Secret: c["twitter"]["access_secret"]}
+}
+
+func twitterUploadRequest(method string, params url.Values, res interface{}) error {
+	oauthclient, credentials := twitterOAuth()
+	var resp *http.Response
+	var err error
+	if method == http.MethodGet {
+		resp, err = oauthclient.Get(http.DefaultClient, credentials, twitter_upload_url_, params)
+	} else {
+		resp, err = oauthclient.Post(http.DefaultClient, credentials, twitter_upload_url_, params)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errbody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("twitter media upload %s: %s: %s", params.Get("command"), resp.Status, strings.TrimSpace(string(errbody)))
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+/// INIT, APPEND each chunk of the size bytes of contents, FINALIZE and wait for twitter to process the upload. Returns the media id.
+/// We only ever hold one chunk in memory.
+func twitterUploadMediaChunked(contents io.Reader, size int64, mimetype, category string) (string, error) {
+	var initresp twitterUploadResponse
+	if err := twitterUploadRequest(http.MethodPost, url.Values{
+		"command":        {"INIT"},
+		"total_bytes":    {strconv.FormatInt(size, 10)},
+		"media_type":     {mimetype},
+		"media_category": {category},
+	}, &initresp); err != nil {
+		return "", err
+	}
+	mediaid := initresp.MediaIDString
+
+	chunk := make([]byte, twitter_upload_chunk_size_)
+	for segment := 0; ; segment++ {
+		numread, readerr := io.ReadFull(contents, chunk)
+		if numread > 0 {
+			if err := twitterUploadRequest(http.MethodPost, url.Values{
+				"command":       {"APPEND"},
+				"media_id":      {mediaid},
+				"segment_index": {strconv.Itoa(segment)},
+				"media_data":    {base64.StdEncoding.EncodeToString(chunk[:numread])},
+			}, nil); err != nil {
+				return "", err
+			}
+		}
+		if readerr == io.EOF || readerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readerr != nil {
+			return "", readerr
+		}
+	}
+
+	var status twitterUploadResponse
+	if err := twitterUploadRequest(http.MethodPost, url.Values{"command": {"FINALIZE"}, "media_id": {mediaid}}, &status); err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(twitter_media_processing_max_wait_)
+	for status.ProcessingInfo != nil {
+		switch status.ProcessingInfo.State {
+		case "succeeded":
+			return mediaid, nil
+		case "failed":
+			if status.ProcessingInfo.Error != nil {
+				return "", fmt.Errorf("twitter could not process media: %s", status.ProcessingInfo.Error.Message)
+			}
+			return "", fmt.Errorf("twitter could not process media")
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("twitter still processing media %s, giving up", mediaid)
+		}
+		time.Sleep(time.Duration(status.ProcessingInfo.CheckAfterSecs+1) * time.Second)
+		status = twitterUploadResponse{}
+		if err := twitterUploadRequest(http.MethodGet, url.Values{"command": {"STATUS"}, "media_id": {mediaid}}, &status); err != nil {
+			return "", err
+		}
+	}
+	return mediaid, nil
+}
+
+/// the metadata endpoint wants JSON, which go-oauth can't post, so we only let it sign the request
+func twitterSetAltText(mediaid, alttext string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"media_id": mediaid,
+		"alt_text": map[string]string{"text": truncateRunes(alttext, twitter_alt_text_max_chars_)},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, twitter_metadata_url_, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	oauthclient, credentials := twitterOAuth()
+	if err = oauthclient.SetAuthorizationHeader(req.Header, credentials, http.MethodPost, req.URL, nil); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		errbody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("twitter media metadata: %s: %s", resp.Status, strings.TrimSpace(string(errbody)))
+	}
+	return nil
+}
+
+func twitterSetAltTextOrLog(mediaid, alttext string) {
+	if len(alttext) == 0 {
+		return
+	}
+	if err := twitterSetAltText(mediaid, alttext); err != nil {
+		log.Println("twitterSetAltText:", err)
+	}
+}